@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// alertHook is called for sender whose blacklister error rate, a fraction of
+// failed calls, exceeded threshold
+type alertHook func(sender string, errRate float64)
+
+// withAlertHook makes handler calculate blacklister error rate of every
+// sender over each interval, calling hook for senders whose rate exceeds
+// threshold. Senders without blacklister calls within interval are skipped.
+func withAlertHook(h *handler, threshold float64, interval time.Duration, hook alertHook) *handler {
+	go h.watchErrorRates(h.ctx, threshold, interval, hook)
+	return h
+}
+
+// watchErrorRates compares sender counters every interval with their
+// previous snapshot until ctx is canceled
+func (h *handler) watchErrorRates(ctx context.Context, threshold float64, interval time.Duration, hook alertHook) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	prev := h.senderCounts()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cur := h.senderCounts()
+		for _, sender := range sortedKeys(cur) {
+			c, p := cur[sender], prev[sender]
+			if !c.ResetAt.Equal(p.ResetAt) {
+				p = senderCounts{} // counters were reset since previous snapshot
+			}
+			errs := c.Errors - p.Errors
+			total := errs + c.Processed - p.Processed
+			if total == 0 {
+				continue
+			}
+			if rate := float64(errs) / float64(total); rate > threshold {
+				hook(sender, rate)
+			}
+		}
+		prev = cur
+	}
+}
+
+// slackAlertHook returns alertHook posting message to Slack incoming webhook
+// url. Failed posts are logged to logger.
+func slackAlertHook(webhookURL string, logger *log.Logger) alertHook {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(sender string, errRate float64) {
+		body, err := json.Marshal(map[string]string{
+			"text": fmt.Sprintf("bouncehandler: error rate of %q blacklister is %.1f%%", sender, errRate*100),
+		})
+		if err != nil {
+			logger.Printf("slack alert: %v", err)
+			return
+		}
+		resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logger.Printf("slack alert: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			logger.Printf("slack alert: unexpected response status: %s", resp.Status)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpConsumer consumes SES notifications from RabbitMQ queue, i.e. ones
+// forwarded by SQS-to-RabbitMQ bridge, and passes them to handler. Message
+// bodies may either be SNS-wrapped or raw SES notification json.
+type amqpConsumer struct {
+	url      string
+	exchange string // fanout exchange queue is bound to
+	queue    string
+	h        *handler
+}
+
+func newAMQPConsumer(url, exchange, queue string, h *handler) *amqpConsumer {
+	return &amqpConsumer{url: url, exchange: exchange, queue: queue, h: h}
+}
+
+// Run consumes messages until ctx is canceled, reconnecting with exponential
+// backoff if connection fails. Messages are acknowledged once queued for
+// processing; malformed ones are logged and rejected without requeue.
+func (c *amqpConsumer) Run(ctx context.Context) error {
+	const minDelay, maxDelay = time.Second, time.Minute
+	delay := minDelay
+	for {
+		start := time.Now()
+		err := c.consume(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Since(start) > maxDelay {
+			delay = minDelay
+		}
+		c.h.log.Printf("amqp: %v, reconnecting in %v", err, delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// consume connects to broker and processes messages until connection fails
+// or ctx is canceled
+func (c *amqpConsumer) consume(ctx context.Context) error {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.ExchangeDeclare(c.exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if _, err := ch.QueueDeclare(c.queue, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err := ch.QueueBind(c.queue, "", c.exchange, false, nil); err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(c.queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d, ok := <-deliveries:
+			if !ok {
+				return errors.New("delivery channel closed")
+			}
+			if err := c.h.consume(d.Body); err != nil {
+				c.h.log.Printf("amqp message %s: %v", d.MessageId, err)
+				if err := d.Reject(false); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.Ack(false); err != nil {
+				return err
+			}
+		}
+	}
+}
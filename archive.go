@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// s3Archive stores raw SNS notifications in S3 bucket
+type s3Archive struct {
+	bucket, prefix string
+	client         s3iface.S3API
+}
+
+// withS3Archive makes handler store body of every SNS notification it
+// processes as s3://bucket/prefix/YYYY/MM/DD/<message id>.json, for
+// compliance and replay with -replay-dir. Objects are written in background
+// before notification is dispatched, failures are only logged.
+func withS3Archive(h *handler, bucket, prefix string, client s3iface.S3API) *handler {
+	h.archive = &s3Archive{bucket: bucket, prefix: prefix, client: client}
+	return h
+}
+
+// store writes body of SNS message with given id to S3 in background. Does
+// nothing if a is nil.
+func (a *s3Archive) store(lg *log.Logger, id string, body []byte) {
+	if a == nil || id == "" {
+		return
+	}
+	key := path.Join(a.prefix, time.Now().UTC().Format("2006/01/02"), id+".json")
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if _, err := a.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(a.bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		}); err != nil {
+			lg.Printf("s3 archive %s: %v", key, err)
+		}
+	}()
+}
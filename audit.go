@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// bufferedAuditLog is io.WriteCloser buffering writes to underlying writer,
+// so that high volume logging to file does not cost a syscall per line.
+// Buffer is flushed when full, every flush interval, and on Close.
+type bufferedAuditLog struct {
+	mu sync.Mutex
+	bw *bufio.Writer
+	w  io.Writer
+
+	done chan struct{}
+	once sync.Once
+}
+
+// newBufferedAuditLog wraps w with buffer of given size, which is flushed at
+// least every flushInterval
+func newBufferedAuditLog(w io.Writer, size int, flushInterval time.Duration) *bufferedAuditLog {
+	l := &bufferedAuditLog{
+		bw:   bufio.NewWriterSize(w, size),
+		w:    w,
+		done: make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-ticker.C:
+				l.Flush()
+			}
+		}
+	}()
+	return l
+}
+
+func (l *bufferedAuditLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bw.Write(p)
+}
+
+// Flush writes buffered data to underlying writer
+func (l *bufferedAuditLog) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bw.Flush()
+}
+
+// Close stops periodic flushing, flushes buffer and closes underlying writer
+// if it is io.Closer
+func (l *bufferedAuditLog) Close() error {
+	l.once.Do(func() { close(l.done) })
+	err := l.Flush()
+	if c, ok := l.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
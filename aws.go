@@ -0,0 +1,11 @@
+package main
+
+import "github.com/aws/aws-sdk-go/aws/session"
+
+// newAWSSession returns AWS session configured from the environment and
+// shared config files
+func newAWSSession() (*session.Session, error) {
+	return session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+// azureServiceBusConsumer receives SES notifications from Azure Service Bus
+// queue and passes them to handler. Message bodies may either be
+// SNS-wrapped or raw SES notification json.
+type azureServiceBusConsumer struct {
+	c *azservicebus.Client
+	r *azservicebus.Receiver
+	h *handler
+}
+
+func newAzureServiceBusConsumer(connString, queue string, h *handler) (*azureServiceBusConsumer, error) {
+	c, err := azservicebus.NewClientFromConnectionString(connString, nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.NewReceiverForQueue(queue, nil)
+	if err != nil {
+		c.Close(context.Background())
+		return nil, err
+	}
+	return &azureServiceBusConsumer{c: c, r: r, h: h}, nil
+}
+
+// Run receives messages until ctx is canceled or receiver fails. Messages
+// are completed once queued for processing; malformed ones are logged and
+// abandoned, so that Service Bus dead-letters them after max delivery count.
+func (c *azureServiceBusConsumer) Run(ctx context.Context) error {
+	for {
+		msgs, err := c.r.ReceiveMessages(ctx, 10, nil)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if err := c.h.consume(m.Body); err != nil {
+				c.h.log.Printf("service bus message %s: %v", m.MessageID, err)
+				if err := c.r.AbandonMessage(ctx, m, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := c.r.CompleteMessage(ctx, m, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Close closes underlying Service Bus receiver and client
+func (c *azureServiceBusConsumer) Close() error {
+	c.r.Close(context.Background())
+	return c.c.Close(context.Background())
+}
@@ -3,270 +3,2985 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
+	mathrand "math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/artyom/autoflags"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/time/rate"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		if err := validateCmd(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	args := struct {
 		Addr string `flag:"addr,address to listen at"`
-		Conf string `flag:"config,configuration file"`
+		Unix string `flag:"listen-unix,unix socket path to listen at instead of -addr"`
+		Conf string `flag:"config,configuration file or glob pattern matching several files"`
 		User string `flag:"user,basic auth user"`
 		Pass string `flag:"pass,basic auth password"`
+
+		HMACSecret string `flag:"hmac-secret,require requests to be signed with HMAC-SHA256 of body keyed by this secret"`
+		HMACHeader string `flag:"hmac-header,header carrying request signature for -hmac-secret"`
+
+		ConfURL     string        `flag:"config-url,http(s) url to fetch configuration from instead of -config"`
+		ConfToken   string        `flag:"config-token,bearer token to authenticate -config-url requests"`
+		ConfRefresh time.Duration `flag:"config-refresh-interval,how often to re-fetch -config-url and apply changes (0 to disable)"`
+
+		Dev bool `flag:"dev,re-read -config on incoming requests, at most once per second (unsafe for production)"`
+
+		ReadTimeout  time.Duration `flag:"read-timeout,max duration of reading http request"`
+		WriteTimeout time.Duration `flag:"write-timeout,max duration of writing http response"`
+		IdleTimeout  time.Duration `flag:"idle-timeout,how long to keep idle keep-alive connections open"`
+		ReqTimeout   time.Duration `flag:"request-timeout,respond with 503 if request processing takes longer, keep below -write-timeout (0 to disable)"`
+
+		Pprof string `flag:"pprof-addr,address to serve unauthenticated /debug/pprof/ handlers at"`
+
+		Metrics string `flag:"metrics-addr,address to serve unauthenticated Prometheus /metrics at"`
+
+		ManageAddr  string `flag:"manage-addr,address to serve management API at"`
+		ManageToken string `flag:"manage-token,bearer token required by management API"`
+
+		SecretRefresh time.Duration `flag:"secret-refresh-interval,how often to re-read dsn_secret values (0 to disable)"`
+		StartTimeout  time.Duration `flag:"startup-timeout,how long to wait for each database to respond when connecting"`
+
+		FallbackURL    string `flag:"fallback-url,url to forward notifications for unconfigured senders to"`
+		FallbackSecret string `flag:"fallback-secret,secret to sign forwarded notifications with"`
+
+		DefaultKey string `flag:"default-key,configuration key of catch-all sender record"`
+
+		Exclude string `flag:"exclude,comma-separated emails, @domain or local@ patterns to never blacklist"`
+
+		MXTimeout time.Duration `flag:"mx-validation-timeout,skip emails whose domain has no MX records, resolving them with this timeout (0 to disable)"`
+		MXServer  string        `flag:"mx-dns-server,host:port of DNS server to resolve MX records with instead of system resolver"`
+
+		CWNamespace string `flag:"cloudwatch-namespace,publish bounce and complaint counts to this CloudWatch namespace"`
+		SNSTopic    string `flag:"forward-sns-topic,publish processed bounces and complaints as json to this SNS topic ARN"`
+
+		ArchiveBucket string `flag:"archive-s3-bucket,store every received SNS notification in this S3 bucket"`
+		ArchivePrefix string `flag:"archive-s3-prefix,key prefix of -archive-s3-bucket objects"`
+
+		RateAlert float64 `flag:"bounce-rate-alert,log warning when sender's 15 minute bounce rate exceeds this fraction (0 to disable)"`
+
+		ErrAlert      float64       `flag:"error-rate-alert,alert when fraction of failed blacklister calls of sender within -error-rate-interval exceeds this (0 to disable)"`
+		ErrInterval   time.Duration `flag:"error-rate-interval,interval to calculate -error-rate-alert over"`
+		ErrAlertSlack string        `flag:"error-rate-slack-webhook,post -error-rate-alert alerts to this Slack incoming webhook url instead of logging them"`
+
+		QueueDir string `flag:"queue-dir,directory to persist queued emails in so they survive restarts"`
+
+		Replay string `flag:"replay-dir,process SNS notifications from .json files in this directory and exit"`
+
+		Once   bool `flag:"once,process single SNS notification read from stdin and exit"`
+		DryRun bool `flag:"dry-run,allow records of noop type which only log emails instead of blacklisting them"`
+
+		FieldMap string `flag:"field-mapping,json file mapping SES notification field names to ones used by SES-like gateway"`
+
+		Canonicalize bool `flag:"canonicalize-gmail,strip dots and +tag suffixes from local part of gmail.com and googlemail.com emails"`
+
+		NoNormalize bool `flag:"no-normalize,pass emails to database as is, without lowercasing"`
+		LogRawBody  bool `flag:"debug-log-raw-body,log first 512 bytes of unparseable request bodies (may leak emails into logs)"`
+		MaskPII     bool `flag:"mask-emails,replace local part of email addresses in logs with ***"`
+
+		LogSample float64 `flag:"log-sample-rate,fraction of per-recipient log lines to write, from 0 to 1"`
+		LogFormat string  `flag:"log-format,log format: text or json (structured, with SNS message metadata)"`
+		LogTime   string  `flag:"log-timestamp-format,timestamp format of text logs: default, rfc3339 or unix"`
+
+		AuditLog    string        `flag:"audit-log,append request and processing logs to this file instead of stderr"`
+		AuditBuffer int           `flag:"audit-log-buffer,size of -audit-log write buffer in bytes"`
+		AuditFlush  time.Duration `flag:"audit-log-flush-interval,how often to flush -audit-log buffer"`
+
+		AccessLog string `flag:"access-log,append access log of http requests in combined log format to this file (- for stdout)"`
+
+		RateLimit      float64 `flag:"rate-limit,max blacklister calls per second for each sender (0 for no limit)"`
+		MaxConcurrency int     `flag:"max-concurrency,max blacklister calls running at once across all senders (0 for no limit)"`
+		MaxRegs        int     `flag:"max-registrations,max number of blacklisters of root handler and of each tenant, records with complaint_sql take two (0 for no limit)"`
+
+		BPThreshold int           `flag:"back-pressure-threshold,delay responses while sender queue holds this many emails (0 to disable)"`
+		BPWait      time.Duration `flag:"back-pressure-wait,how long to delay response before asking SNS to retry"`
+
+		Retries    int           `flag:"retries,call failing blacklisters up to this many times in total (0 or 1 to not retry)"`
+		RetryDelay time.Duration `flag:"retry-delay,delay before the first retry of blacklister call, doubled on every next one"`
+
+		OrderWindow time.Duration `flag:"ordering-window,hold notifications this long to process them per sender in event timestamp order (0 to disable)"`
+
+		Overflow string `flag:"overflow,what to drop when sender queue is full: drop-newest or drop-oldest"`
+
+		ConfirmTimeout time.Duration `flag:"confirm-timeout,timeout of requests following SNS subscription confirmation urls"`
+		MaxConfirms    int           `flag:"max-confirmations-per-minute,respond with 429 to subscription confirmations above this rate (0 for no limit)"`
+		ConfirmPins    string        `flag:"subscribe-cert-pins,comma-separated SHA-256 fingerprints of certificates accepted when following subscription urls"`
+
+		DedupSize  int           `flag:"dedup-cache-size,remember ids of this many recent SNS messages to skip duplicates (0 to disable)"`
+		DedupRedis string        `flag:"dedup-redis-url,remember SNS message ids in Redis at this url instead of memory"`
+		DedupTTL   time.Duration `flag:"dedup-ttl,how long to remember SNS message ids"`
+
+		MaxAge time.Duration `flag:"max-message-age,reject SNS messages older than this (0 to accept any)"`
+		Topics string        `flag:"topics,comma-separated list of accepted SNS topic ARNs (empty accepts any)"`
+
+		Methods  string `flag:"allowed-methods,comma-separated list of HTTP methods accepted for SNS messages"`
+		StrictCT bool   `flag:"strict-content-type,reject SNS requests with Content-Type other than text/plain or application/json"`
+
+		BounceOnly    bool `flag:"bounce-only,acknowledge complaint notifications without processing them"`
+		ComplaintOnly bool `flag:"complaint-only,acknowledge bounce notifications without processing them"`
+
+		KafkaBrokers string `flag:"kafka-brokers,comma-separated list of Kafka brokers to consume from instead of serving http"`
+		KafkaTopic   string `flag:"kafka-topic,Kafka topic with SNS notifications"`
+		KafkaGroup   string `flag:"kafka-group,Kafka consumer group id"`
+
+		PubSubProject string `flag:"pubsub-project,GCP project to receive Pub/Sub messages in instead of serving http"`
+		PubSubSub     string `flag:"pubsub-subscription,Pub/Sub subscription with SES notifications"`
+
+		AzureConn  string `flag:"azure-servicebus-connection-string,Azure Service Bus connection string to receive messages with instead of serving http"`
+		AzureQueue string `flag:"azure-queue-name,Azure Service Bus queue with SES notifications"`
+
+		AMQPURL      string `flag:"amqp-url,RabbitMQ url to consume messages from instead of serving http"`
+		AMQPExchange string `flag:"amqp-exchange,RabbitMQ fanout exchange to bind -amqp-queue to"`
+		AMQPQueue    string `flag:"amqp-queue,RabbitMQ queue with SNS notifications"`
+
+		SQSQueue string `flag:"sqs-queue-url,SQS queue url to receive SNS notifications from instead of serving http"`
+		SQSRaw   bool   `flag:"sqs-raw,-sqs-queue-url messages are SES notifications, as with SNS raw message delivery"`
+
+		PublicURL string `flag:"public-url,base url SNS reaches this service at, printed on startup as subscription endpoint (default derived from -tls-domain)"`
+
+		TLSDomain string `flag:"tls-domain,serve https with Let's Encrypt certificate for this domain (requires -addr on port 443)"`
+		ACMECache string `flag:"acme-cache,directory to cache Let's Encrypt certificates"`
+		TLSCert   string `flag:"tls-cert,serve https with certificate from this file"`
+		TLSKey    string `flag:"tls-key,private key file for -tls-cert"`
+		TLSCA     string `flag:"tls-ca,require client certificates signed by CA from this file (needs https)"`
+
+		TLSReload time.Duration `flag:"tls-reload-interval,how often to check -tls-cert and -tls-key for changes and reload them (0 to disable)"`
+
+		Version bool `flag:"version,print build information and exit"`
 	}{
-		Addr: "localhost:8080",
-		Conf: "mapping.json",
+		Addr:           "localhost:8080",
+		Conf:           "mapping.json",
+		DefaultKey:     defaultKey,
+		SecretRefresh:  time.Hour,
+		ConfRefresh:    5 * time.Minute,
+		ACMECache:      "acme-cache",
+		ErrInterval:    5 * time.Minute,
+		TLSReload:      time.Minute,
+		KafkaGroup:     "bouncehandler",
+		Overflow:       string(dropNewest),
+		HMACHeader:     signatureHeader,
+		DedupTTL:       24 * time.Hour,
+		StartTimeout:   pingTimeout,
+		ConfirmTimeout: 10 * time.Second,
+		AMQPExchange:   "bouncehandler",
+		BPWait:         5 * time.Second,
+		LogSample:      1,
+		LogFormat:      "text",
+		LogTime:        "default",
+		AuditBuffer:    64 << 10,
+		AuditFlush:     time.Second,
+		ReadTimeout:    30 * time.Second,
+		WriteTimeout:   30 * time.Second,
+		IdleTimeout:    2 * time.Minute,
+		ReqTimeout:     25 * time.Second,
+		Methods:        http.MethodPost,
+		RetryDelay:     time.Second,
+	}
+	autoflags.Define(&args)
+	flag.Parse()
+	if args.Version {
+		printVersion(os.Stdout)
+		return
+	}
+	pingTimeout = args.StartTimeout
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	if err := setTimestampFormat(logger, args.LogTime); err != nil {
+		logger.Fatal(err)
+	}
+	if args.DefaultKey == "" {
+		logger.Fatal("-default-key cannot be empty")
+	}
+	defaultKey = args.DefaultKey
+	var conf *config
+	var err error
+	switch {
+	case args.ConfURL != "" && flagIsSet("config"):
+		logger.Fatal("-config and -config-url are mutually exclusive")
+	case args.ConfURL != "":
+		conf, err = readConfigURL(args.ConfURL, args.ConfToken)
+	default:
+		conf, err = loadConfig(args.Conf, flagIsSet("config"))
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+	var fields fieldMapping
+	if args.FieldMap != "" {
+		if fields, err = readFieldMapping(args.FieldMap); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if args.Once && args.Replay != "" {
+		logger.Fatal("-once and -replay-dir are mutually exclusive")
+	}
+	if args.BounceOnly && args.ComplaintOnly {
+		logger.Fatal("-bounce-only and -complaint-only are mutually exclusive")
+	}
+	var ignored []string
+	switch {
+	case args.BounceOnly:
+		ignored = append(ignored, "Complaint")
+	case args.ComplaintOnly:
+		ignored = append(ignored, "Bounce")
+	}
+	if args.Once || args.Replay != "" {
+		h := withNormalize(withLog(newHandler(), logger), !args.NoNormalize)
+		if args.Exclude != "" {
+			h = withEmailExclusions(h, strings.Split(args.Exclude, ",")...)
+		}
+		if args.MXTimeout > 0 {
+			h = withMXValidation(h, args.MXTimeout)
+			if args.MXServer != "" {
+				h = withCustomResolver(h, dnsServerResolver(args.MXServer))
+			}
+		}
+		h = withFieldMapping(h, fields)
+		h = withIgnoredTypes(h, ignored...)
+		if args.Canonicalize {
+			h = withCanonicalization(h, gmailRules)
+		}
+		lc := &liveConfig{h: h, log: logger, dryRun: args.DryRun}
+		if args.Replay != "" {
+			err = runReplay(lc, conf, args.Replay)
+		} else {
+			err = runOnce(lc, conf, os.Stdin)
+		}
+		if err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	var store idempotencyStore
+	if args.DedupRedis != "" {
+		if store, err = newRedisStore(args.DedupRedis); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if args.LogFormat != "text" && args.LogFormat != "json" {
+		logger.Fatalf("invalid -log-format value: %q", args.LogFormat)
+	}
+	if strings.Trim(args.Methods, ", ") == "" {
+		logger.Fatal("-allowed-methods cannot be empty")
+	}
+	if args.ErrAlert > 0 && args.ErrInterval <= 0 {
+		logger.Fatal("-error-rate-interval should be positive with -error-rate-alert")
+	}
+	if args.MaskPII && args.LogRawBody {
+		logger.Fatal("-mask-emails and -debug-log-raw-body are mutually exclusive")
+	}
+	policy := overflowPolicy(args.Overflow)
+	if policy != dropNewest && policy != dropOldest {
+		logger.Fatalf("invalid -overflow value: %q", args.Overflow)
+	}
+	var cw cloudwatchiface.CloudWatchAPI
+	if args.CWNamespace != "" {
+		sess, err := newAWSSession()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		cw = cloudwatch.New(sess)
+	}
+	var snsClient snsiface.SNSAPI
+	if args.SNSTopic != "" {
+		sess, err := newAWSSession()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		snsClient = sns.New(sess)
+	}
+	var s3Client s3iface.S3API
+	if args.ArchiveBucket != "" {
+		sess, err := newAWSSession()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		s3Client = s3.New(sess)
+	}
+	var logOut io.Writer = os.Stderr
+	hlog := logger
+	// fatal is logger.Fatal flushing -audit-log buffer first
+	fatal := logger.Fatal
+	if args.AuditLog != "" {
+		if args.AuditFlush <= 0 {
+			logger.Fatal("-audit-log-flush-interval should be positive")
+		}
+		f, err := os.OpenFile(args.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		audit := newBufferedAuditLog(f, args.AuditBuffer, args.AuditFlush)
+		logOut = audit
+		hlog = log.New(logOut, "", log.LstdFlags)
+		setTimestampFormat(hlog, args.LogTime) // already validated
+		fatal = func(v ...any) {
+			audit.Close()
+			logger.Fatal(v...)
+		}
+		go closeOnSignal(audit)
+	}
+	// configured returns handler with options from command line, tenant
+	// handlers only differ by queue directory
+	configured := func(tenant string) *handler {
+		h := withLog(newHandler(), hlog)
+		if args.LogFormat == "json" {
+			h = withSlogHandler(h, slog.NewJSONHandler(logOut, nil))
+		}
+		if args.HMACSecret != "" {
+			h = withHMACAuth(h, args.HMACSecret, args.HMACHeader)
+		}
+		h = withRateLimit(h, args.RateLimit)
+		h = withGlobalConcurrencyLimit(h, args.MaxConcurrency)
+		h = withMaxRegistrations(h, args.MaxRegs)
+		h = withNormalize(h, !args.NoNormalize)
+		if args.Canonicalize {
+			h = withCanonicalization(h, gmailRules)
+		}
+		h = withRawBodyLogging(h, args.LogRawBody)
+		h = withLogSampling(h, args.LogSample)
+		h = withPIIMasking(h, args.MaskPII)
+		h = withFieldMapping(h, fields)
+		if args.Retries > 1 {
+			h.Use(retryMiddleware(h.ctx, args.Retries, args.RetryDelay))
+		}
+		if args.RateAlert > 0 {
+			h = withBounceRateAlert(h, args.RateAlert, func(sender string, rate float64) {
+				logger.Printf("WARNING: bounce rate of %q is %.1f%%", sender, rate*100)
+			})
+		}
+		if args.ErrAlert > 0 {
+			hook := alertHook(func(sender string, rate float64) {
+				logger.Printf("WARNING: blacklister error rate of %q is %.1f%%", sender, rate*100)
+			})
+			if args.ErrAlertSlack != "" {
+				hook = slackAlertHook(args.ErrAlertSlack, logger)
+			}
+			h = withAlertHook(h, args.ErrAlert, args.ErrInterval, hook)
+		}
+		h = withMaxMessageAge(h, args.MaxAge)
+		h = withMaxConfirmationsPerMinute(h, args.MaxConfirms)
+		h = withConfirmTimeout(h, args.ConfirmTimeout)
+		if args.WriteTimeout > 0 {
+			h = withConfirmBudget(h, args.WriteTimeout*4/5)
+		}
+		if args.ConfirmPins != "" {
+			h = withSubscribeCertPins(h, strings.Split(args.ConfirmPins, ",")...)
+		}
+		h = withOverflowPolicy(h, policy)
+		if args.OrderWindow > 0 {
+			h = withTimestampOrdering(h, args.OrderWindow)
+		}
+		if args.BPThreshold > 0 {
+			h = withBackPressure(h, args.BPThreshold, args.BPWait)
+		}
+		switch {
+		case store != nil:
+			h = withIdempotencyStore(h, store, args.DedupTTL)
+		case args.DedupSize > 0:
+			h = withDeduplicationCacheSize(h, args.DedupSize)
+			h = withDeduplicationTTL(h, args.DedupTTL)
+		}
+		if args.FallbackURL != "" {
+			h = withFallbackWebhook(h, args.FallbackURL, args.FallbackSecret)
+		}
+		if args.Exclude != "" {
+			h = withEmailExclusions(h, strings.Split(args.Exclude, ",")...)
+		}
+		if args.MXTimeout > 0 {
+			h = withMXValidation(h, args.MXTimeout)
+			if args.MXServer != "" {
+				h = withCustomResolver(h, dnsServerResolver(args.MXServer))
+			}
+		}
+		if cw != nil {
+			h = withCloudWatchMetrics(h, args.CWNamespace, cw)
+		}
+		if snsClient != nil {
+			h = withForwardToSNS(h, args.SNSTopic, snsClient)
+		}
+		if s3Client != nil {
+			h = withS3Archive(h, args.ArchiveBucket, args.ArchivePrefix, s3Client)
+		}
+		if args.QueueDir != "" {
+			dir := args.QueueDir
+			if tenant != "" {
+				dir = filepath.Join(dir, tenantsKey, tenant)
+			}
+			h = withPersistentQueue(h, dir)
+		}
+		if args.Topics != "" {
+			h = withAllowedTopics(h, strings.Split(args.Topics, ",")...)
+		}
+		h = withAllowedMethods(h, strings.Split(args.Methods, ",")...)
+		h = withStrictContentType(h, args.StrictCT)
+		h = withIgnoredTypes(h, ignored...)
+		return h
+	}
+	h := withBasicAuth(configured(""), args.User, args.Pass)
+	switch {
+	case args.PublicURL != "":
+		if u, err := url.Parse(args.PublicURL); err != nil || u.Host == "" {
+			fatal(fmt.Sprintf("invalid -public-url value: %q", args.PublicURL))
+		}
+		h = withPublicURL(h, args.PublicURL)
+	case args.TLSDomain != "":
+		h = withPublicURL(h, "https://"+args.TLSDomain)
+	}
+	cfg := &liveConfig{h: h, refresh: args.SecretRefresh, log: logger,
+		newTenant: configured, dryRun: args.DryRun}
+	if err := cfg.apply(conf); err != nil {
+		fatal(err)
+	}
+	if args.ConfURL != "" && args.ConfRefresh > 0 {
+		go func() {
+			for range time.Tick(args.ConfRefresh) {
+				conf, err := readConfigURL(args.ConfURL, args.ConfToken)
+				if err == nil {
+					err = cfg.apply(conf)
+				}
+				if err != nil {
+					logger.Printf("config reload: %v", err)
+				}
+			}
+		}()
+	}
+	if args.Pprof != "" {
+		go func() { fatal(servePprof(args.Pprof, logger)) }()
+	}
+	if args.Metrics != "" {
+		go func() { fatal(serveMetrics(args.Metrics, h, logger)) }()
+	}
+	if args.ManageAddr != "" {
+		if args.ManageToken == "" {
+			fatal("-manage-token should be set with -manage-addr")
+		}
+		go func() { fatal(serveManagement(args.ManageAddr, args.ManageToken, cfg, logger)) }()
+	}
+	if args.KafkaBrokers != "" {
+		if args.KafkaTopic == "" {
+			fatal("-kafka-topic should be set with -kafka-brokers")
+		}
+		c := newKafkaConsumer(strings.Split(args.KafkaBrokers, ","),
+			args.KafkaTopic, args.KafkaGroup, h)
+		fatal(c.Run(context.Background()))
+	}
+	if args.PubSubProject != "" {
+		if args.PubSubSub == "" {
+			fatal("-pubsub-subscription should be set with -pubsub-project")
+		}
+		c, err := newPubSubConsumer(context.Background(), args.PubSubProject, args.PubSubSub, h)
+		if err != nil {
+			fatal(err)
+		}
+		fatal(c.Run(context.Background()))
+	}
+	if args.AzureConn != "" {
+		if args.AzureQueue == "" {
+			fatal("-azure-queue-name should be set with -azure-servicebus-connection-string")
+		}
+		c, err := newAzureServiceBusConsumer(args.AzureConn, args.AzureQueue, h)
+		if err != nil {
+			fatal(err)
+		}
+		fatal(c.Run(context.Background()))
+	}
+	if args.AMQPURL != "" {
+		if args.AMQPQueue == "" {
+			fatal("-amqp-queue should be set with -amqp-url")
+		}
+		c := newAMQPConsumer(args.AMQPURL, args.AMQPExchange, args.AMQPQueue, h)
+		fatal(c.Run(context.Background()))
+	}
+	if args.SQSQueue != "" {
+		sess, err := newAWSSession()
+		if err != nil {
+			fatal(err)
+		}
+		c := newSQSConsumer(args.SQSQueue, args.SQSRaw, sqs.New(sess), h)
+		fatal(c.Run(context.Background()))
+	}
+	var root http.Handler = h
+	if args.Dev {
+		if args.ConfURL != "" {
+			fatal("-dev only works with -config")
+		}
+		logger.Print("WARNING: running in -dev mode, do not use it in production")
+		root = &devReloader{next: h, lc: cfg, load: func() (*config, error) {
+			return loadConfig(args.Conf, flagIsSet("config"))
+		}, last: time.Now()}
+	}
+	if args.ReqTimeout > 0 {
+		root = http.TimeoutHandler(root, args.ReqTimeout, "request processing timed out")
+	}
+	switch args.AccessLog {
+	case "":
+	case "-":
+		root = accessLogHandler(root, log.New(os.Stdout, "", 0))
+	default:
+		f, err := os.OpenFile(args.AccessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			fatal(err)
+		}
+		root = accessLogHandler(root, log.New(f, "", 0))
+	}
+	server := &http.Server{
+		Addr:         args.Addr,
+		Handler:      root,
+		ReadTimeout:  args.ReadTimeout,
+		WriteTimeout: args.WriteTimeout,
+		IdleTimeout:  args.IdleTimeout,
+		ErrorLog:     logger,
+	}
+	tlsConfig, err := serverTLSConfig(args.TLSDomain, args.ACMECache,
+		args.TLSCert, args.TLSKey, args.TLSCA, args.TLSReload, logger)
+	if err != nil {
+		fatal(err)
+	}
+	if args.Unix != "" && flagIsSet("addr") {
+		fatal("-addr and -listen-unix are mutually exclusive")
+	}
+	ln, err := listen(args.Addr, args.Unix)
+	if err != nil {
+		fatal(err)
+	}
+	if u := h.SubscribeURL(); u != "" {
+		logger.Printf("subscribe SNS topics to %s", u)
+	}
+	if tlsConfig != nil {
+		server.TLSConfig = tlsConfig
+		fatal(server.ServeTLS(ln, "", ""))
+	}
+	fatal(server.Serve(ln))
+}
+
+// closeOnSignal closes c once process receives SIGINT or SIGTERM, then
+// terminates process by the same signal
+func closeOnSignal(c io.Closer) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	c.Close()
+	signal.Reset(sig)
+	if p, err := os.FindProcess(os.Getpid()); err == nil {
+		p.Signal(sig)
+	}
+}
+
+// listen opens unix socket listener if socket path is set, or tcp listener
+// on addr otherwise. Stale socket file left from the previous run is removed.
+// If BOUNCE_LISTENER_FD environment variable is set, listening socket is
+// instead inherited from parent process as file descriptor of this number.
+func listen(addr, socket string) (net.Listener, error) {
+	if v := os.Getenv("BOUNCE_LISTENER_FD"); v != "" {
+		fd, err := strconv.Atoi(v)
+		if err != nil || fd < 3 {
+			return nil, fmt.Errorf("invalid BOUNCE_LISTENER_FD value: %q", v)
+		}
+		f := os.NewFile(uintptr(fd), "inherited listener")
+		defer f.Close() // FileListener dups descriptor
+		return net.FileListener(f)
+	}
+	if socket == "" {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Stat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", socket)
+}
+
+// newBlacklister creates blacklister for config record, secret-based DSNs are
+// re-read with a given refresh interval. Returned io.Closer releases
+// blacklister resources.
+func newBlacklister(c cred, refresh time.Duration, logger *log.Logger) (blacklister, io.Closer, error) {
+	if c.Type == typeMongo {
+		return mongoBlacklister(c.URI, c.Database, c.Collection, c.Field)
+	}
+	if c.Type == typeSQLite {
+		return sqliteBlacklister(c.Path, c.Table, c.Field)
+	}
+	if c.Type == typeNoop {
+		return func(email string) error {
+			logger.Printf("NOOP: would suppress %s", email)
+			return nil
+		}, closerFunc(func() error { return nil }), nil
+	}
+	if c.DSNSecret != "" {
+		r, err := awsSecrets()
+		if err != nil {
+			return nil, nil, err
+		}
+		return secretBlacklister(r, c.DSNSecret, c.sql(), c.poolConfig, refresh, logger, c.queryArgs())
+	}
+	dsn, err := c.fileDSN()
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.IAMAuth {
+		return iamBlacklister(dsn, c.sql(), c.poolConfig, logger, c.queryArgs())
+	}
+	return sqlBlacklister(dsn, c.sql(), c.poolConfig, c.queryArgs())
+}
+
+// sqlBlacklister returns blacklister executing query with arguments made of
+// queued item by args, which may be nil if query only takes email
+func sqlBlacklister(dsn, query string, p poolConfig, args queryArgs) (blacklister, io.Closer, error) {
+	db, err := openDB(dsn, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(email string) error {
+		_, err := db.Exec(query, args.of(email)...)
+		return err
+	}, dbChecker{db}, nil
+}
+
+// closerFunc adapts function to io.Closer interface
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// openDB opens MySQL database with given pool settings and verifies
+// connection is usable within pingTimeout
+func openDB(dsn string, p poolConfig) (*sql.DB, error) {
+	dsn, err := p.dsn(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	p.apply(db)
+	if err := pingDB(db, dsn); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// pingDB verifies db connection is usable within pingTimeout
+func pingDB(db *sql.DB, dsn string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("connecting to %s timed out after %v", dsnName(dsn), pingTimeout)
+		}
+		return err
+	}
+	return nil
+}
+
+// pingTimeout limits how long openDB waits for database to respond
+var pingTimeout = 10 * time.Second
+
+// dsnName returns DSN with password stripped, suitable for log messages
+func dsnName(dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "database"
+	}
+	return fmt.Sprintf("%s@%s(%s)/%s", cfg.User, cfg.Net, cfg.Addr, cfg.DBName)
+}
+
+// loadConfig reads config from the named file, or from environment if file
+// name was not given explicitly and environment has config variables.
+func loadConfig(name string, explicit bool) (*config, error) {
+	if !explicit && hasEnvConfig() {
+		senders, err := readConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return &config{senders: senders}, nil
+	}
+	return readConfig(name)
+}
+
+// readConfig reads config from the named file. If name is a glob pattern,
+// all matching files are read and merged; the same key may not be present in
+// more than one file.
+func readConfig(name string) (*config, error) {
+	if !strings.ContainsAny(name, "*?[") {
+		return readConfigFile(name)
+	}
+	names, err := filepath.Glob(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no files match %q", name)
+	}
+	out := &config{senders: make(map[string]cred)}
+	seen := make(map[string]string) // key to file name
+	for _, name := range names {
+		conf, err := readConfigFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		base := len(out.senders)
+		for k, v := range conf.senders {
+			if prev, ok := seen[k]; ok {
+				return nil, fmt.Errorf("record for %q is present in both %s and %s",
+					k, prev, name)
+			}
+			seen[k] = name
+			v.order += base
+			out.senders[k] = v
+		}
+		for k, v := range conf.tenants {
+			if prev, ok := seen[tenantsKey+"/"+k]; ok {
+				return nil, fmt.Errorf("tenant %q is present in both %s and %s",
+					k, prev, name)
+			}
+			seen[tenantsKey+"/"+k] = name
+			if out.tenants == nil {
+				out.tenants = make(map[string]tenantConfig)
+			}
+			out.tenants[k] = v
+		}
+	}
+	return out, nil
+}
+
+func readConfigFile(name string) (*config, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeConfig(f)
+}
+
+// readConfigURL fetches config from http(s) url, authenticating with bearer
+// token if it is not empty
+func readConfigURL(url, token string) (*config, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := configClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("config fetch: unexpected response status: %s", resp.Status)
+	}
+	return decodeConfig(resp.Body)
+}
+
+var configClient = &http.Client{Timeout: 30 * time.Second}
+
+// config is a parsed configuration: sender records served at the root path
+// and tenants with their own sender records
+type config struct {
+	senders map[string]cred
+	tenants map[string]tenantConfig
+}
+
+// tenantsKey is a top-level config key holding tenants instead of sender
+// record
+const tenantsKey = "tenants"
+
+func decodeConfig(r io.Reader) (*config, error) {
+	b, err := io.ReadAll(io.LimitReader(r, 2<<20))
+	if err != nil {
+		return nil, err
+	}
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(b, &top); err != nil {
+		return nil, err
+	}
+	conf := new(config)
+	if raw, ok := top[tenantsKey]; ok {
+		delete(top, tenantsKey)
+		if conf.tenants, err = decodeTenants(raw); err != nil {
+			return nil, err
+		}
+	}
+	if len(top) == 0 && len(conf.tenants) != 0 {
+		return conf, nil
+	}
+	if conf.senders, err = decodeSenders(b, top); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// decodeSenders decodes and validates sender records of json object b,
+// already split into raw, recording their order
+func decodeSenders(b []byte, raw map[string]json.RawMessage) (map[string]cred, error) {
+	out := make(map[string]cred, len(raw))
+	for k, v := range raw {
+		var c cred
+		if err := json.Unmarshal(v, &c); err != nil {
+			return nil, fmt.Errorf("record for %q: %w", k, err)
+		}
+		out[k] = c
+	}
+	if err := validateConfig(out); err != nil {
+		return nil, err
+	}
+	keys, err := objectKeys(b)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		if v, ok := out[k]; ok {
+			v.order = i
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+// decodeTenants decodes value of top-level "tenants" config key
+func decodeTenants(b []byte) (map[string]tenantConfig, error) {
+	var raw map[string]struct {
+		User    string          `json:"user"`
+		Pass    string          `json:"pass"`
+		Senders json.RawMessage `json:"senders"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", tenantsKey, err)
+	}
+	out := make(map[string]tenantConfig, len(raw))
+	for name, t := range raw {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid tenant name %q", name)
+		}
+		var senders map[string]json.RawMessage
+		if err := json.Unmarshal(t.Senders, &senders); err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", name, err)
+		}
+		m, err := decodeSenders(t.Senders, senders)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", name, err)
+		}
+		out[name] = tenantConfig{User: t.User, Pass: t.Pass, Senders: m}
+	}
+	return out, nil
+}
+
+// objectKeys returns keys of top-level json object in the order they appear,
+// so that sender patterns can be evaluated in config order
+func objectKeys(b []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil { // opening brace
+		return nil, err
+	}
+	var keys []string
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, t.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// readConfigFromEnv builds config from BOUNCE_SENDER_<N>_NAME,
+// BOUNCE_SENDER_<N>_DSN and BOUNCE_SENDER_<N>_SQL environment variables, where
+// <N> is an arbitrary suffix grouping variables of the same record.
+func readConfigFromEnv() (map[string]cred, error) {
+	out := make(map[string]cred)
+	for _, kv := range os.Environ() {
+		k, name, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(k, envPrefix) || !strings.HasSuffix(k, "_NAME") {
+			continue
+		}
+		n := strings.TrimSuffix(k, "_NAME")
+		if _, ok := out[name]; ok {
+			return nil, fmt.Errorf("duplicate record for %q in environment", name)
+		}
+		out[name] = cred{
+			DSN:   os.Getenv(n + "_DSN"),
+			Query: os.Getenv(n + "_SQL"),
+		}
+	}
+	if err := validateConfig(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// hasEnvConfig reports whether any BOUNCE_SENDER_* variable is set
+func hasEnvConfig() bool {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateConfig(out map[string]cred) error {
+	if len(out) == 0 {
+		return fmt.Errorf("empty config")
+	}
+	for k, v := range out {
+		if _, err := filepath.Match(k, ""); err != nil {
+			return fmt.Errorf("invalid sender pattern %q: %v", k, err)
+		}
+		if len(v.Tags) > 29 { // CloudWatch limit of 30 dimensions, Sender included
+			return fmt.Errorf("invalid tags for %q: too many", k)
+		}
+		for name := range v.Tags {
+			if name == "" || name == "Sender" {
+				return fmt.Errorf("invalid tags for %q: reserved or empty tag name %q", k, name)
+			}
+		}
+		switch v.Type {
+		case "", typeMySQL:
+		case typeMongo:
+			if v.URI == "" || v.Database == "" || v.Collection == "" {
+				return fmt.Errorf("invalid record for %q, uri, database and collection should be set", k)
+			}
+			continue
+		case typeSQLite:
+			if v.Path == "" || v.Table == "" {
+				return fmt.Errorf("invalid record for %q, path and table should be set", k)
+			}
+			continue
+		case typeNoop:
+			continue
+		default:
+			return fmt.Errorf("invalid type for %q: %q", k, v.Type)
+		}
+		if v.Query == "" || countNonEmpty(v.DSN, v.DSNSecret, v.DSNFile) != 1 {
+			return fmt.Errorf("invalid record for %q, sql and exactly one of dsn, dsn_secret, dsn_file should be set", k)
+		}
+		switch {
+		case v.PassComplaintType && v.PassBounceType:
+			return fmt.Errorf("invalid record for %q, pass_bounce_type and pass_complaint_type are mutually exclusive", k)
+		case v.PassComplaintType && v.ComplaintQuery == "":
+			return fmt.Errorf("invalid record for %q, pass_complaint_type requires complaint_sql", k)
+		}
+		want, complaintWant := 1, 1
+		if v.PassBounceType {
+			want, complaintWant = 2, 2
+		}
+		if v.PassComplaintType {
+			complaintWant = 2
+		}
+		style, err := placeholderStyleOf(v.Driver)
+		if err != nil {
+			return fmt.Errorf("invalid record for %q: %v", k, err)
+		}
+		if err := checkPlaceholders(style, v.Query, want); err != nil {
+			return fmt.Errorf("invalid sql for %q: %v", k, err)
+		}
+		if v.ComplaintQuery != "" {
+			if err := checkPlaceholders(style, v.ComplaintQuery, complaintWant); err != nil {
+				return fmt.Errorf("invalid complaint_sql for %q: %v", k, err)
+			}
+		}
+		switch v.Mode {
+		case "", modeExec:
+		case modeUpsert:
+			if _, err := upsertQuery(v.Query); err != nil {
+				return fmt.Errorf("invalid sql for %q: %v", k, err)
+			}
+		default:
+			return fmt.Errorf("invalid mode for %q: %q", k, v.Mode)
+		}
+	}
+	return nil
+}
+
+func countNonEmpty(ss ...string) int {
+	var n int
+	for _, s := range ss {
+		if s != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// flagIsSet reports whether flag with given name was set on command line
+func flagIsSet(name string) bool {
+	var found bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+type cred struct {
+	Type string `json:"type"` // typeMySQL (default), typeMongo, typeSQLite or typeNoop
+
+	Query     string `json:"sql"`
+	DSN       string `json:"dsn"`
+	DSNSecret string `json:"dsn_secret"` // name of the AWS secret holding DSN
+	DSNFile   string `json:"dsn_file"`   // path to file holding DSN
+	Mode      string `json:"mode"`       // modeExec (default) or modeUpsert
+	IAMAuth   bool   `json:"iam_auth"`   // authenticate to RDS with IAM token
+	Driver    string `json:"driver"`     // placeholder style of queries, see placeholderStyleOf
+	poolConfig
+
+	ComplaintQuery string `json:"complaint_sql"` // if set, used for complaints instead of sql
+
+	// if set, query takes notification type, "Bounce" or "Complaint", as
+	// second argument
+	PassBounceType bool `json:"pass_bounce_type"`
+	// if set, complaint query takes complaint feedback type as first
+	// argument, and email as second one
+	PassComplaintType bool `json:"pass_complaint_type"`
+
+	// used with typeMongo
+	URI        string `json:"uri"`
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+	Field      string `json:"field"` // defaults to "email", also used with typeSQLite
+
+	// used with typeSQLite
+	Path  string `json:"path"`
+	Table string `json:"table"`
+
+	Tags map[string]string `json:"tags"` // added to log lines and metrics of this record
+
+	order int // position of record in config, sender patterns are tried in this order
+
+	policy bounceType // notification type passed to query with PassBounceType
+}
+
+const (
+	typeMySQL  = "mysql"
+	typeMongo  = "mongo"
+	typeSQLite = "sqlite"
+	typeNoop   = "noop" // only logs emails, allowed with -dry-run
+)
+
+// poolConfig holds database connection pool settings, zero values mean
+// defaults, negative ones mean no limit
+type poolConfig struct {
+	MaxOpenConns    int      `json:"max_open_conns"`
+	MaxIdleConns    int      `json:"max_idle_conns"`
+	ConnMaxLifetime duration `json:"conn_max_lifetime"`
+	ConnMaxIdleTime duration `json:"conn_max_idle_time"` // keep below server's wait_timeout
+
+	// if set, override timeout and readTimeout parameters of MySQL DSN
+	DialTimeout duration `json:"dial_timeout"`
+	ReadTimeout duration `json:"read_timeout"`
+}
+
+// dsn returns MySQL DSN with timeouts of p set
+func (p poolConfig) dsn(dsn string) (string, error) {
+	if p.DialTimeout <= 0 && p.ReadTimeout <= 0 {
+		return dsn, nil
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	if p.DialTimeout > 0 {
+		cfg.Timeout = time.Duration(p.DialTimeout)
+	}
+	if p.ReadTimeout > 0 {
+		cfg.ReadTimeout = time.Duration(p.ReadTimeout)
+	}
+	return cfg.FormatDSN(), nil
+}
+
+// apply configures db pool, substituting conservative defaults
+func (p poolConfig) apply(db *sql.DB) {
+	db.SetMaxOpenConns(orDefault(p.MaxOpenConns, 5))
+	db.SetMaxIdleConns(orDefault(p.MaxIdleConns, 2))
+	db.SetConnMaxLifetime(time.Duration(orDefault(int64(p.ConnMaxLifetime),
+		int64(5*time.Minute))))
+	db.SetConnMaxIdleTime(time.Duration(orDefault(int64(p.ConnMaxIdleTime),
+		int64(5*time.Minute))))
+}
+
+// orDefault returns def if v is zero, zero if v is negative, or v otherwise
+func orDefault[T int | int64](v, def T) T {
+	switch {
+	case v == 0:
+		return def
+	case v < 0:
+		return 0
+	}
+	return v
+}
+
+// duration is a time.Duration which is represented in json as a string
+// like "1m30s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+const (
+	modeExec   = "exec"   // run query as is
+	modeUpsert = "upsert" // make insert query update existing rows
+)
+
+// fileDSN returns DSN, reading it from DSNFile if set
+func (c cred) fileDSN() (string, error) {
+	if c.DSNFile == "" {
+		return c.DSN, nil
+	}
+	b, err := os.ReadFile(c.DSNFile)
+	if err != nil {
+		return "", err
+	}
+	dsn := strings.TrimSpace(string(b))
+	if dsn == "" {
+		return "", fmt.Errorf("%s: empty dsn", c.DSNFile)
+	}
+	return dsn, nil
+}
+
+// queryArgs makes SQL query arguments from queued item
+type queryArgs func(item string) []any
+
+// of returns query arguments for queued item, nil args only pass item
+func (a queryArgs) of(item string) []any {
+	if a == nil {
+		return []any{item}
+	}
+	return a(item)
+}
+
+// queryArgs returns arguments function for c query, nil if query only takes
+// email once. Arguments are ordered as numbered placeholders of query refer
+// to them.
+func (c cred) queryArgs() queryArgs {
+	var args queryArgs
+	switch {
+	case c.PassComplaintType && c.policy == complaintOnly:
+		args = func(item string) []any {
+			reason, email, _ := strings.Cut(item, reasonSep)
+			return []any{reason, email}
+		}
+	case c.PassBounceType:
+		typ := string(c.policy)
+		args = func(item string) []any { return []any{item, typ} }
+	}
+	style, _ := placeholderStyleOf(c.Driver)
+	_, _, order, _ := style.normalize(c.Query)
+	if order == nil {
+		return args
+	}
+	return func(item string) []any {
+		in := args.of(item)
+		out := make([]any, len(order))
+		for i, n := range order {
+			out[i] = in[n]
+		}
+		return out
+	}
+}
+
+// sql returns query to run, rewritten according to cred mode and with
+// placeholders normalized to ? ones. It should only be called on validated
+// records.
+func (c cred) sql() string {
+	q := c.Query
+	if c.Mode == modeUpsert {
+		q, _ = upsertQuery(q)
+	}
+	style, _ := placeholderStyleOf(c.Driver)
+	q, _, _, _ = style.normalize(q)
+	return q
+}
+
+// upsertQuery turns "INSERT INTO tbl (a, b) VALUES (...)" query into
+// "INSERT ... ON DUPLICATE KEY UPDATE a=VALUES(a), b=VALUES(b)" one, so that
+// repeated bounces for the same email update existing row instead of failing.
+func upsertQuery(query string) (string, error) {
+	q := strings.TrimRight(strings.TrimSpace(query), ";")
+	upper := strings.ToUpper(q)
+	if !strings.HasPrefix(upper, "INSERT ") {
+		return "", fmt.Errorf("upsert mode requires INSERT query")
+	}
+	if strings.Contains(upper, "ON DUPLICATE KEY") {
+		return "", fmt.Errorf("upsert mode query should not have ON DUPLICATE KEY clause")
+	}
+	i, j := strings.Index(q, "("), strings.Index(q, ")")
+	if i < 0 || j < i || !strings.Contains(upper[:i], " INTO ") {
+		return "", fmt.Errorf("upsert mode requires INSERT INTO table (columns...) query")
+	}
+	var set []string
+	for _, col := range strings.Split(q[i+1:j], ",") {
+		col = strings.TrimSpace(col)
+		if col == "" {
+			return "", fmt.Errorf("upsert mode query has empty column name")
+		}
+		set = append(set, col+"=VALUES("+col+")")
+	}
+	return q + " ON DUPLICATE KEY UPDATE " + strings.Join(set, ", "), nil
+}
+
+// handler processes SQS+SNS bounce notifications sent to http/https endpoint.
+// It automatically responds to subscribe confirmation SNS calls. Use Register
+// function to add processing for given sender.
+type handler struct {
+	mu     sync.RWMutex // guards m, patterns, tenants, mws, checkers, events and counters
+	m      map[queueKey]*queue
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	log    *log.Logger
+
+	counters map[string]*senderStats // by sender of m keys, kept once unregistered
+
+	closeOnce sync.Once // guards shutdown by Close and CloseWithTimeout
+	closeErr  error     // result of the first CloseWithTimeout call
+
+	patterns []string // sender patterns from m in registration order
+	tenants  map[string]*tenant
+	mws      []middleware // wrap blacklisters on registration
+	checkers map[string]checker
+
+	health healthCache // recent results of checks
+
+	user, pass string // credentials for http basic authentication
+
+	hmacSecret, hmacHeader string // if set, requests must carry body signature
+
+	topics map[string]struct{} // if non-empty, only these topic ARNs are accepted
+	rps    float64             // per-sender blacklister calls per second limit
+
+	methods []string // HTTP methods accepted for SNS messages
+
+	strictContentType bool // whether to reject unexpected Content-Type
+
+	ignored map[string]bool // notification types acknowledged without processing
+
+	publicURL string // base url SNS reaches handler at, if known
+
+	normalize bool // whether to lowercase emails before blacklisting
+
+	canonical map[string]canonicalizationRule // if not nil, applied to emails by domain
+
+	queueDir string // if set, sender queues are persisted in this directory
+
+	fallbackURL, fallbackSecret string // where to forward unhandled messages
+
+	fields fieldMapping // if not nil, renames notification fields before parsing
+
+	exclude map[string]struct{} // emails, "@domain" and "local@" patterns to skip
+	mx      *mxValidator        // if not nil, emails of domains without MX are skipped
+
+	onComplaint func(complaintEvent) // called on every complained recipient
+
+	cw *cwMetrics // nil unless CloudWatch metrics are enabled
+
+	maxAge time.Duration // if positive, older SNS messages are rejected
+
+	sem chan struct{} // if not nil, limits concurrent blacklister calls
+
+	errs chan<- error // if not nil, receives blacklister errors
+
+	maxRegs int // if positive, limits number of registered blacklisters
+
+	order *timestampOrderer // if not nil, notifications are held to be reordered
+
+	stream  *snsStream // if not nil, processed events are published there
+	archive *s3Archive // if not nil, received notifications are stored there
+
+	events *eventChans // if not nil, recipients are also sent to its channels
+
+	slog *slog.Logger // if not nil, used for structured request logs
+
+	chanSize   int                        // capacity of in-memory queue of every sender
+	overflow   overflowPolicy             // what to drop when in-memory queue is full
+	onOverflow func(sender, email string) // called for every dropped email
+
+	bpThreshold int           // if positive, queue length to wait below
+	bpWait      time.Duration // how long to wait for queue to drain
+
+	logRawBody bool    // whether to log bodies of unparseable requests
+	maskPII    bool    // whether to mask email addresses in logs
+	logSample  float64 // fraction of per-recipient log lines to write
+
+	sync     bool    // call blacklisters directly from enqueue, see runOnce
+	syncErrs []error // blacklister errors in synchronous mode
+
+	seen    idempotencyStore // if not nil, used to skip duplicate messages
+	seenTTL time.Duration
+
+	confirmClient *http.Client  // used to follow subscription confirmation urls
+	confirmBudget time.Duration // if positive, limits time of confirm with all its retries
+
+	stats       snsStats
+	rates       bounceRateTracker
+	confirmRate *rate.Limiter // if not nil, limits subscription confirmations
+}
+
+// complaintEvent describes complaint about email from Sender to Email
+type complaintEvent struct {
+	Sender       string
+	Email        string
+	FeedbackType string    // like "abuse" or "not-spam"
+	ArrivalDate  time.Time // when complaint was received by ISP
+	UserAgent    string    // of the ISP feedback loop
+}
+
+// queueKey identifies blacklister registered for sender to process
+// notifications of given type
+type queueKey struct {
+	sender string
+	policy bounceType
+}
+
+// bounceType is the type of notification, as in payload.Type
+type bounceType string
+
+const (
+	anyType       bounceType = ""
+	bounceOnly    bounceType = "Bounce"
+	complaintOnly bounceType = "Complaint"
+	deliveryOnly  bounceType = "Delivery" // never handled by anyType blacklisters
+	notSpamOnly   bounceType = "not-spam" // complaints with "not-spam" feedback type
+)
+
+// exclusive reports whether notifications of type t may only be handled by
+// blacklisters registered for t, not by anyType ones
+func (t bounceType) exclusive() bool { return t == deliveryOnly || t == notSpamOnly }
+
+// overflowPolicy defines which email is dropped when in-memory queue is full
+type overflowPolicy string
+
+const (
+	dropNewest overflowPolicy = "drop-newest" // incoming email is dropped
+	dropOldest overflowPolicy = "drop-oldest" // longest queued email is dropped
+)
+
+// queue holds emails to be processed by sender's blacklister
+type queue struct {
+	ch   chan string
+	disk *diskQueue // if not nil, emails are queued here and then fed to ch
+
+	stop   chan struct{} // closed to stop worker
+	done   chan struct{} // closed once worker exited
+	closer io.Closer     // resources of blacklister, may be nil
+
+	direct blacklister // set instead of running worker in synchronous mode
+
+	tags map[string]string // from cred.Tags
+
+	withReason bool // items are reason+reasonSep+email, see queueOpts
+
+	batch batchBlacklister // if not nil, called instead of blacklister
+
+	stats *senderStats // shared by all queues of the sender
+}
+
+// queueOpts are optional settings of registered queue
+type queueOpts struct {
+	tags map[string]string // added to log lines and metrics
+
+	// if set, recipient bounce diagnostic or complaint feedback type is
+	// queued along with email, separated by reasonSep
+	withReason bool
+
+	batch batchBlacklister // see RegisterBatch
+}
+
+const reasonSep = "\x00"
+
+// email returns email of queued item, without reason if it holds one
+func (s *queue) email(item string) string {
+	if !s.withReason {
+		return item
+	}
+	_, email, _ := strings.Cut(item, reasonSep)
+	return email
+}
+
+// tagInfo returns queue tags formatted for log line
+func (s *queue) tagInfo() string { return formatTags(s.tags) }
+
+// formatTags returns tags as space-prefixed key:value pairs sorted by key,
+// or empty string if there are no tags
+func formatTags(tags map[string]string) string {
+	var b strings.Builder
+	for _, k := range sortedKeys(tags) {
+		fmt.Fprintf(&b, " %s:%q", k, tags[k])
+	}
+	return b.String()
+}
+
+// newHandler returns initialized handler
+func newHandler() *handler {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &handler{
+		m:         make(map[queueKey]*queue),
+		counters:  make(map[string]*senderStats),
+		ctx:       ctx,
+		cancel:    cancel,
+		log:       log.New(ioutil.Discard, "", 0),
+		normalize: true,
+		chanSize:  100,
+		overflow:  dropNewest,
+		logSample: 1,
+		methods:   []string{http.MethodPost},
+
+		confirmClient: newConfirmClient(),
+	}
+}
+
+// withLog attaches logger to handler
+func withLog(h *handler, logger *log.Logger) *handler {
+	h.log = logger
+	return h
+}
+
+// withBasicAuth makes handler require basic http authentication
+func withBasicAuth(h *handler, user, pass string) *handler {
+	h.user, h.pass = user, pass
+	return h
+}
+
+// withHMACAuth makes handler require header carrying hex-encoded
+// HMAC-SHA256 of raw request body keyed by secret, optionally prefixed with
+// "sha256=", as added by a reverse proxy. Requests with missing or invalid
+// signature are rejected with 401 status.
+func withHMACAuth(h *handler, secret, header string) *handler {
+	h.hmacSecret, h.hmacHeader = secret, header
+	return h
+}
+
+// withAllowedTopics makes handler reject messages from SNS topics other
+// than listed
+func withAllowedTopics(h *handler, arns ...string) *handler {
+	h.topics = make(map[string]struct{}, len(arns))
+	for _, arn := range arns {
+		h.topics[strings.TrimSpace(arn)] = struct{}{}
+	}
+	return h
+}
+
+// withAllowedMethods sets HTTP methods accepted for SNS messages, requests
+// with other methods are rejected with 405 status. Only POST, which SNS
+// uses, is accepted by default.
+func withAllowedMethods(h *handler, methods ...string) *handler {
+	h.methods = h.methods[:0]
+	for _, m := range methods {
+		if m = strings.ToUpper(strings.TrimSpace(m)); m != "" {
+			h.methods = append(h.methods, m)
+		}
+	}
+	return h
+}
+
+// withStrictContentType makes handler reject SNS requests with 415 status
+// unless their Content-Type is text/plain, which SNS sends, or
+// application/json
+func withStrictContentType(h *handler, enable bool) *handler {
+	h.strictContentType = enable
+	return h
+}
+
+// withPublicURL sets base url SNS topics reach handler at, as returned by
+// SubscribeURL
+func withPublicURL(h *handler, base string) *handler {
+	h.publicURL = base
+	return h
+}
+
+// SubscribeURL returns endpoint url to subscribe SNS topics to, or empty
+// string if public url is unknown. Basic authentication credentials are not
+// included.
+func (h *handler) SubscribeURL() string {
+	u, err := url.Parse(h.publicURL)
+	if err != nil || h.publicURL == "" {
+		return ""
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.User = nil
+	return u.String()
+}
+
+// withIgnoredTypes makes handler acknowledge notifications of given types,
+// such as "Complaint", without processing or logging them
+func withIgnoredTypes(h *handler, types ...string) *handler {
+	h.ignored = make(map[string]bool, len(types))
+	for _, t := range types {
+		h.ignored[t] = true
+	}
+	return h
+}
+
+// withNormalize controls whether emails are lowercased before passing them
+// to blacklisters, it is enabled by default
+func withNormalize(h *handler, enabled bool) *handler {
+	h.normalize = enabled
+	return h
+}
+
+// withRateLimit limits how often each sender's blacklister is called. It
+// only affects senders registered afterwards.
+func withRateLimit(h *handler, perSenderRPS float64) *handler {
+	h.rps = perSenderRPS
+	return h
+}
+
+// withPersistentQueue makes handler keep queued emails on disk in given
+// directory, so they are processed after restart if process was stopped
+// before handling them. It only affects senders registered afterwards.
+func withPersistentQueue(h *handler, dir string) *handler {
+	h.queueDir = dir
+	return h
+}
+
+// withFallbackWebhook makes handler forward SNS messages for senders without
+// registered blacklister to given url. Request body is signed with secret,
+// see forward method.
+func withFallbackWebhook(h *handler, url, secret string) *handler {
+	h.fallbackURL, h.fallbackSecret = url, secret
+	return h
+}
+
+// withEmailExclusions makes handler skip emails matching any of the
+// patterns, which are either exact emails, "@domain" to match the whole
+// domain or "local@" to match local part in any domain, like "postmaster@".
+// Matching is case insensitive.
+func withEmailExclusions(h *handler, patterns ...string) *handler {
+	h.exclude = make(map[string]struct{}, len(patterns))
+	for _, p := range patterns {
+		h.exclude[emailNormalize(p)] = struct{}{}
+	}
+	return h
+}
+
+// excluded reports whether email matches one of exclusion patterns
+func (h *handler) excluded(email string) bool {
+	if len(h.exclude) == 0 {
+		return false
+	}
+	email = emailNormalize(email)
+	if _, ok := h.exclude[email]; ok {
+		return true
+	}
+	i := strings.LastIndexByte(email, '@')
+	if i < 0 {
+		return false
+	}
+	if _, ok := h.exclude[email[i:]]; ok {
+		return true
+	}
+	_, ok := h.exclude[email[:i+1]]
+	return ok
+}
+
+// withComplaintHook makes handler call f synchronously for every complained
+// recipient before it is queued for blacklisting
+func withComplaintHook(h *handler, f func(complaintEvent)) *handler {
+	h.onComplaint = f
+	return h
+}
+
+// withCloudWatchMetrics makes handler publish BounceCount and ComplaintCount
+// metrics with Sender dimension to CloudWatch namespace, along with
+// IntendedRecipients: total number of recipients of bounced and complained
+// emails. Metrics are aggregated and sent once a minute.
+func withCloudWatchMetrics(h *handler, namespace string, client cloudwatchiface.CloudWatchAPI) *handler {
+	h.cw = newCWMetrics(namespace, client)
+	go h.cw.loop(h.ctx, h.log, time.Minute)
+	return h
+}
+
+// withMaxMessageAge makes handler reject SNS messages with timestamp older
+// than d to prevent replay of captured notifications
+func withMaxMessageAge(h *handler, d time.Duration) *handler {
+	h.maxAge = d
+	return h
+}
+
+// withChannelSize sets capacity of in-memory queue of blacklisters registered
+// afterwards, 100 by default
+func withChannelSize(h *handler, n int) *handler {
+	h.chanSize = n
+	return h
+}
+
+// withOverflowPolicy sets which emails are dropped when sender's in-memory
+// queue is full
+func withOverflowPolicy(h *handler, p overflowPolicy) *handler {
+	h.overflow = p
+	return h
+}
+
+// withNotSpamHandler makes handler pass recipients of complaints with
+// "not-spam" feedback type to f instead of suppressing them, i.e. to remove
+// them from suppression table. Use RegisterWithPolicy with notSpamOnly policy
+// to set such handler for specific sender.
+func withNotSpamHandler(h *handler, f blacklister) *handler {
+	if err := h.register(queueKey{defaultKey, notSpamOnly}, f, nil, queueOpts{}, false); err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// withBackPressure makes handler wait up to maxWait for sender's in-memory
+// queue to hold less than threshold emails instead of dropping them. If queue
+// does not drain in time, request is rejected with 503 status, so that SNS
+// retries it later.
+func withBackPressure(h *handler, threshold int, maxWait time.Duration) *handler {
+	h.bpThreshold, h.bpWait = threshold, maxWait
+	return h
+}
+
+// withOverflowHook makes handler call f for every email dropped because
+// sender's in-memory queue is full. f is called synchronously from request
+// handling goroutine, so it should not block for long.
+func withOverflowHook(h *handler, f func(sender, email string)) *handler {
+	h.onOverflow = f
+	return h
+}
+
+// withMaxRegistrations limits number of blacklisters that can be registered
+// with handler, each of which runs its own worker goroutine. Registrations
+// above the limit fail, replacing existing ones is still allowed.
+func withMaxRegistrations(h *handler, n int) *handler {
+	h.maxRegs = n
+	return h
+}
+
+// withErrorChannel makes handler send every blacklister error to ch, in
+// addition to logging it. Errors are sent without blocking, so they are
+// dropped if ch is not ready to receive them; use buffered channel.
+func withErrorChannel(h *handler, ch chan<- error) *handler {
+	h.errs = ch
+	return h
+}
+
+// reportError sends blacklister error for email from sender to error
+// channel, if any
+func (h *handler) reportError(sender, email string, err error) {
+	if h.errs == nil {
+		return
+	}
+	select {
+	case h.errs <- fmt.Errorf("sender %q, email %q: %w", sender, email, err):
+	default:
+	}
+}
+
+// withConfirmTimeout sets timeout of requests following SNS subscription
+// confirmation urls
+func withConfirmTimeout(h *handler, d time.Duration) *handler {
+	h.confirmClient.Timeout = d
+	return h
+}
+
+// withConfirmBudget limits total time of following subscription confirmation
+// url, retries included, to d. Keep it below server write timeout, so that
+// SNS gets response on whether confirmation succeeded.
+func withConfirmBudget(h *handler, d time.Duration) *handler {
+	h.confirmBudget = d
+	return h
+}
+
+// withLogSampling makes handler only log given fraction (0.0-1.0) of lines
+// about individual recipients, with a summary line for each notification.
+// Errors and overflows are always logged.
+func withLogSampling(h *handler, rate float64) *handler {
+	h.logSample = rate
+	return h
+}
+
+// sampled reports whether line about individual recipient should be logged
+func (h *handler) sampled() bool {
+	return h.logSample >= 1 || mathrand.Float64() < h.logSample
+}
+
+// withRawBodyLogging makes handler log first 512 bytes of request body when
+// it cannot be parsed as SNS message. Such bodies may contain email addresses.
+func withRawBodyLogging(h *handler, enable bool) *handler {
+	h.logRawBody = enable
+	return h
+}
+
+// withPIIMasking makes handler replace local part of email addresses in its
+// logs with "***"
+func withPIIMasking(h *handler, enabled bool) *handler {
+	h.maskPII = enabled
+	return h
+}
+
+// pii returns email as it should be logged
+func (h *handler) pii(email string) string {
+	if !h.maskPII {
+		return email
+	}
+	return maskEmail(email)
+}
+
+// maskEmail replaces local part of email address with "***"
+func maskEmail(s string) string {
+	i := strings.LastIndex(s, "@")
+	if i < 0 {
+		return "***"
+	}
+	return "***" + s[i:]
+}
+
+// withIdempotencyStore makes handler skip SNS messages whose MessageId was
+// already processed within ttl
+func withIdempotencyStore(h *handler, store idempotencyStore, ttl time.Duration) *handler {
+	h.seen, h.seenTTL = store, ttl
+	if c, ok := store.(checker); ok {
+		h.AddChecker("idempotency-store", c)
+	}
+	return h
+}
+
+// withDeduplicationCacheSize makes handler skip SNS messages whose MessageId
+// is among ids of n most recently processed ones, kept in memory for ttl set
+// with withDeduplicationTTL, 24 hours by default. It replaces store set with
+// withIdempotencyStore.
+func withDeduplicationCacheSize(h *handler, n int) *handler {
+	h.seen = newLRUStore(n)
+	if h.seenTTL == 0 {
+		h.seenTTL = 24 * time.Hour
+	}
+	return h
+}
+
+// withDeduplicationTTL sets how long handler remembers ids of processed SNS
+// messages
+func withDeduplicationTTL(h *handler, d time.Duration) *handler {
+	h.seenTTL = d
+	return h
+}
+
+// withMaxConfirmationsPerMinute makes handler respond with 429 status to
+// subscription confirmations once more than n of them arrive within a minute
+func withMaxConfirmationsPerMinute(h *handler, n int) *handler {
+	if n > 0 {
+		h.confirmRate = rate.NewLimiter(rate.Limit(float64(n)/60), n)
+	}
+	return h
+}
+
+// withGlobalConcurrencyLimit limits number of blacklister calls running at
+// the same time across all senders
+func withGlobalConcurrencyLimit(h *handler, n int) *handler {
+	if n > 0 {
+		h.sem = make(chan struct{}, n)
+	}
+	return h
+}
+
+// acquire takes a slot of global concurrency limit, it returns false if
+// handler was closed while waiting
+func (h *handler) acquire() bool {
+	if h.sem == nil {
+		return true
+	}
+	select {
+	case h.sem <- struct{}{}:
+		return true
+	case <-h.ctx.Done():
+		return false
+	}
+}
+
+// release frees slot taken by acquire
+func (h *handler) release() {
+	if h.sem != nil {
+		<-h.sem
+	}
+}
+
+// Close signals background goroutines to stop. It is safe to call Close
+// and CloseWithTimeout several times, only the first call has effect.
+func (h *handler) Close() { h.closeOnce.Do(func() { h.cancel(errClosed) }) }
+
+// CloseWithTimeout stops workers of all registered blacklisters, waiting up
+// to d for them to process already queued emails, then signals background
+// goroutines to stop. If workers did not finish in time, they are stopped
+// anyway and Err reports context.DeadlineExceeded. Repeated calls return
+// result of the first one.
+func (h *handler) CloseWithTimeout(d time.Duration) error {
+	h.closeOnce.Do(func() { h.closeErr = h.closeWithTimeout(d) })
+	return h.closeErr
+}
+
+func (h *handler) closeWithTimeout(d time.Duration) error {
+	h.mu.RLock()
+	keys := slices.Collect(maps.Keys(h.m))
+	h.mu.RUnlock()
+	done := make(chan error, 1)
+	go func() {
+		var errs []error
+		for _, k := range keys {
+			errs = append(errs, h.unregister(k))
+		}
+		done <- errors.Join(errs...)
+	}()
+	select {
+	case err := <-done:
+		h.cancel(errClosed)
+		return err
+	case <-time.After(d):
+		h.cancel(context.DeadlineExceeded)
+		return context.DeadlineExceeded
+	}
+}
+
+// Err returns nil while handler is running, errClosed once it was closed,
+// or context.DeadlineExceeded if CloseWithTimeout did not finish in time
+func (h *handler) Err() error { return context.Cause(h.ctx) }
+
+// errClosed is the cause of handler context cancellation on clean shutdown
+var errClosed = errors.New("handler closed")
+
+// Register adds given blacklister function as a processor for bounces for
+// emails that were sent from given srcEmail. It is safe to call Register while
+// handler is serving requests. It panics if srcEmail is already registered.
+//
+// Deprecated: use RegisterFunc, which reports such errors instead.
+func (h *handler) Register(srcEmail string, f blacklister) {
+	h.RegisterWithPolicy(srcEmail, anyType, f)
+}
+
+// RegisterBatch is like Register, but f is called with several emails at
+// once: emails queued together, such as recipients of a single notification,
+// are passed in one call, up to queue capacity. Middlewares added with Use
+// are not applied to f.
+func (h *handler) RegisterBatch(srcEmail string, f batchBlacklister) error {
+	single := func(email string) error { return f([]string{email}) }
+	return h.register(queueKey{srcEmail, anyType}, single, nil, queueOpts{batch: f}, false)
+}
+
+// RegisterFunc is like Register, but returns error instead of panicking if
+// srcEmail is already registered, so it is suitable for registration at run
+// time.
+func (h *handler) RegisterFunc(srcEmail string, f blacklister) error {
+	return h.register(queueKey{srcEmail, anyType}, f, nil, queueOpts{}, false)
+}
+
+// GracefulRegister is like RegisterFunc, but replaces blacklister already
+// registered for srcEmail: new emails are queued for f right away, while
+// emails queued before the call are still passed to the old blacklister,
+// whose worker is stopped once they are processed. f starts receiving
+// emails after that.
+func (h *handler) GracefulRegister(srcEmail string, f blacklister) error {
+	return h.register(queueKey{srcEmail, anyType}, f, nil, queueOpts{}, true)
+}
+
+// RegisterShadow is like RegisterFunc, but also calls shadow for every email
+// after primary, in background, logging emails for which only one of them
+// failed. Only primary errors are reported, so that shadow blacklister,
+// like one with new database schema, can be validated without effect on
+// processing.
+func (h *handler) RegisterShadow(srcEmail string, primary, shadow blacklister) error {
+	return h.RegisterFunc(srcEmail, func(email string) error {
+		err := primary(email)
+		go func() {
+			serr := safeCall(func() error { return shadow(email) })
+			switch {
+			case err == nil && serr != nil:
+				h.log.Printf("shadow blacklister of %q failed on %q: %v", h.pii(srcEmail), h.pii(email), serr)
+			case err != nil && serr == nil:
+				h.log.Printf("shadow blacklister of %q succeeded on %q, primary failed: %v", h.pii(srcEmail), h.pii(email), err)
+			}
+		}()
+		return err
+	})
+}
+
+// RegisterWithPolicy is like Register, but makes f process only notifications
+// of given type. Blacklisters registered for specific type take precedence
+// over ones registered with anyType for the same sender.
+func (h *handler) RegisterWithPolicy(srcEmail string, policy bounceType, f blacklister) {
+	if err := h.register(queueKey{srcEmail, policy}, f, nil, queueOpts{}, false); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterByConfigSet adds f as a processor of bounces and complaints for
+// emails sent with SES configuration set of given name. Such blacklisters
+// take precedence over ones registered for sender address.
+func (h *handler) RegisterByConfigSet(setName string, f blacklister) {
+	h.RegisterWithPolicy(configSetPrefix+setName, anyType, f)
+}
+
+// RegisterByAccount adds f as a processor of bounces and complaints for
+// emails sent from AWS account with given id, for handlers shared by several
+// accounts. Such blacklisters take precedence over ones registered for
+// sender address, but not over configuration set ones.
+func (h *handler) RegisterByAccount(accountID string, f blacklister) {
+	h.RegisterWithPolicy(accountPrefix+accountID, anyType, f)
+}
+
+// Use makes handler wrap blacklisters registered after this call with given
+// middlewares, first one being the outermost.
+func (h *handler) Use(mws ...middleware) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.mws = append(h.mws, mws...)
+}
+
+// RegisterDelivery adds f as a processor of successful delivery notifications
+// for emails sent from srcEmail, i.e. to mark recipients as valid. Delivery
+// notifications are only passed to blacklisters registered with this method.
+func (h *handler) RegisterDelivery(srcEmail string, f blacklister) {
+	h.RegisterWithPolicy(srcEmail, deliveryOnly, f)
+}
+
+// register starts worker running f for emails queued under key. If replace
+// is true, worker already registered under the same key is stopped after
+// processing emails it has queued; otherwise such registration is an error.
+// If closer is not nil, it is called after worker exits.
+func (h *handler) register(key queueKey, f blacklister, closer io.Closer, opts queueOpts, replace bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.mws) - 1; i >= 0; i-- {
+		f = h.mws[i](f)
+	}
+	old, ok := h.m[key]
+	if !ok && h.maxRegs > 0 && len(h.m) >= h.maxRegs {
+		return fmt.Errorf("cannot register handler for sender %q: limit of %d registrations reached", key.sender, h.maxRegs)
+	}
+	if ok && !replace {
+		if key.policy != anyType {
+			return fmt.Errorf("handler for sender %q and type %q is already registered", key.sender, key.policy)
+		}
+		return fmt.Errorf("handler for sender %q is already registered", key.sender)
+	}
+	s := &queue{
+		ch:     make(chan string, h.chanSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		closer: closer,
+		tags:   opts.tags,
+
+		withReason: opts.withReason,
+		batch:      opts.batch,
+		stats:      h.senderStatsFor(key.sender),
+	}
+	switch {
+	case old != nil:
+		s.disk = old.disk
+	case h.queueDir != "":
+		name := key.sender
+		if key.policy != anyType {
+			name += "#" + string(key.policy)
+		}
+		q, err := openDiskQueue(h.queueDir, name)
+		if err != nil {
+			return fmt.Errorf("sender %q queue: %v", key.sender, err)
+		}
+		s.disk = q
+	}
+	h.m[key] = s
+	if isPattern(key.sender) && !slices.Contains(h.patterns, key.sender) {
+		h.patterns = append(h.patterns, key.sender)
+	}
+	if h.sync {
+		s.direct = f
+		return nil
+	}
+	go h.work(key.sender, s, f, old)
+	return nil
+}
+
+// isPattern reports whether sender is a filepath.Match pattern other than
+// catch-all key
+func isPattern(sender string) bool {
+	return sender != defaultKey && strings.ContainsAny(sender, "*?[")
+}
+
+// Unregister removes all blacklisters registered for srcEmail, regardless of
+// notification type. It waits for their workers to process already queued
+// emails and exit, and releases blacklister resources such as database
+// connections. It returns error if srcEmail is not registered.
+func (h *handler) Unregister(srcEmail string) error {
+	h.mu.RLock()
+	var keys []queueKey
+	for k := range h.m {
+		if k.sender == srcEmail {
+			keys = append(keys, k)
+		}
+	}
+	h.mu.RUnlock()
+	if len(keys) == 0 {
+		return fmt.Errorf("handler for sender %q is not registered", srcEmail)
+	}
+	var errs []error
+	for _, k := range keys {
+		errs = append(errs, h.unregister(k))
+	}
+	return errors.Join(errs...)
+}
+
+// unregister stops worker registered under key, waiting for it to process
+// already queued emails
+func (h *handler) unregister(key queueKey) error {
+	h.mu.Lock()
+	s, ok := h.m[key]
+	delete(h.m, key)
+	if i := slices.Index(h.patterns, key.sender); i >= 0 && !h.registered(key.sender) {
+		h.patterns = slices.Delete(h.patterns, i, i+1)
+	}
+	h.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("handler for sender %q is not registered", key.sender)
+	}
+	if s.direct != nil { // no worker in synchronous mode
+		if s.closer != nil {
+			return s.closer.Close()
+		}
+		return nil
+	}
+	close(s.stop)
+	<-s.done
+	if s.disk != nil {
+		return s.disk.Close()
+	}
+	return nil
+}
+
+// registered reports whether m has any entries for sender, h.mu must be held
+func (h *handler) registered(sender string) bool {
+	for k := range h.m {
+		if k.sender == sender {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisteredSenders returns sorted list of senders having blacklisters
+// registered, including "*" default key and patterns
+func (h *handler) RegisteredSenders() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var out []string
+	for k := range h.m {
+		out = append(out, k.sender)
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// work calls f for every email taken from s until handler is closed or s is
+// stopped. If prev is not nil, it is the queue s replaces, and work waits
+// for it to stop first.
+func (h *handler) work(srcEmail string, s *queue, f blacklister, prev *queue) {
+	defer close(s.done)
+	if s.closer != nil {
+		defer s.closer.Close()
+	}
+	if prev != nil {
+		close(prev.stop)
+		<-prev.done
+	}
+	if s.disk != nil {
+		fed := make(chan struct{})
+		defer func() { <-fed }()
+		s.disk.rewind()
+		go func() { defer close(fed); s.disk.feed(h.ctx, s.stop, s.ch) }()
+	}
+	var lim *rate.Limiter
+	if h.rps > 0 {
+		lim = rate.NewLimiter(rate.Limit(h.rps), 1)
+	}
+	process := func(emails []string) bool {
+		for _, email := range emails {
+			if lim != nil && lim.Wait(h.ctx) != nil {
+				h.log.Printf("bounce queue overflow: from:%q to:%q%s",
+					h.pii(srcEmail), h.pii(s.email(email)), s.tagInfo())
+				s.stats.add(0, 0, len(emails))
+				return true
+			}
+		}
+		if !h.acquire() {
+			return false
+		}
+		var err error
+		if s.batch != nil {
+			err = safeCall(func() error { return s.batch(emails) })
+		} else {
+			err = safeCall(func() error { return f(emails[0]) })
+		}
+		h.release()
+		if err != nil {
+			s.stats.add(0, len(emails), 0)
+		} else {
+			s.stats.add(len(emails), 0, 0)
+		}
+		for _, email := range emails {
+			if err != nil {
+				h.log.Printf("%q: %v%s", h.pii(s.email(email)), err, s.tagInfo())
+				h.reportError(srcEmail, s.email(email), err)
+			}
+			if s.disk != nil {
+				if err := s.disk.ack(email); err != nil {
+					h.log.Printf("sender %q queue: %v", h.pii(srcEmail), err)
+				}
+			}
+		}
+		return true
+	}
+	for {
+		select {
+		case email := <-s.ch:
+			if !process(s.collect(email)) {
+				return
+			}
+		case <-s.stop:
+			if s.disk != nil {
+				return // unprocessed emails stay on disk
+			}
+			for {
+				select {
+				case email := <-s.ch:
+					if !process(s.collect(email)) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
+
+// collect returns first email taken from queue, followed by other emails
+// already waiting in it if queue has batch blacklister
+func (s *queue) collect(first string) []string {
+	emails := []string{first}
+	for s.batch != nil && len(emails) < cap(s.ch) {
+		select {
+		case email := <-s.ch:
+			emails = append(emails, email)
+		default:
+			return emails
+		}
+	}
+	return emails
+}
+
+// safeCall calls blacklister through fn, converting its panic to error, so
+// that faulty blacklister cannot crash the process
+func safeCall(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic in blacklister: %v", r)
+		}
+	}()
+	return fn()
+}
+
+// ServeHTTP implements http.Handler interface.
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, tenantPrefix) {
+		h.serveTenant(w, r)
+		return
+	}
+	id := requestID(r)
+	w.Header().Set("X-Request-ID", id)
+	lg, sl := h.requestLoggers(id)
+	ctx := r.Context()
+	if h.user != "" && h.pass != "" {
+		if u, p, ok := r.BasicAuth(); !ok || u != h.user || p != h.pass {
+			if r.URL.Path == healthPath { // for load balancers
+				h.serveHealth(w, r, false)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="private"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.URL.Path == healthPath {
+		h.serveHealth(w, r, true)
+		return
+	}
+	if h.hmacSecret != "" {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 2<<20))
+		if err != nil {
+			sl.WarnContext(ctx, "reading request body", slog.String("error", err.Error()))
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		sig := strings.TrimPrefix(strings.ToLower(r.Header.Get(h.hmacHeader)), "sha256=")
+		if subtle.ConstantTimeCompare([]byte(sig), []byte(bodyMAC(h.hmacSecret, body))) != 1 {
+			sl.WarnContext(ctx, "invalid signature", slog.String("header", h.hmacHeader))
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			sl.WarnContext(ctx, "reading gzip body", slog.String("error", err.Error()))
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		r.Body = io.NopCloser(zr)
+	}
+	if r.URL.Path == submitPath {
+		h.submit(lg, w, r)
+		return
+	}
+	if r.URL.Path == statsPath {
+		h.serveStats(w, r)
+		return
+	}
+	if !slices.Contains(h.methods, r.Method) {
+		w.Header().Set("Allow", strings.Join(h.methods, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if h.strictContentType {
+		mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mt != "text/plain" && mt != "application/json" {
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	// SNS sets this header on every request; it may be missing on ones
+	// re-posted by proxies or fallback forwarding
+	hdrType := r.Header.Get("X-Amz-Sns-Message-Type")
+	switch hdrType {
+	case "", "Notification", "SubscriptionConfirmation", "UnsubscribeConfirmation":
+	default:
+		h.stats.add("")
+		sl.WarnContext(ctx, "unsupported X-Amz-Sns-Message-Type header", slog.String("type", hdrType))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 2<<20))
+	if err != nil {
+		sl.WarnContext(ctx, "reading request body", slog.String("error", err.Error()))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	sns := new(snsMsg)
+	if err := json.Unmarshal(body, sns); err != nil {
+		h.stats.add("")
+		attrs := []any{slog.String("error", err.Error())}
+		if h.logRawBody {
+			if len(body) > 512 {
+				body = body[:512]
+			}
+			attrs = append(attrs, slog.String("body", string(body)))
+		}
+		sl.WarnContext(ctx, "unparseable SNS message", attrs...)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	h.stats.add(sns.Type)
+	lg, sl = h.withTopicContext(lg, sl, sns.TopicArn)
+	if h.duplicate(lg, sns.MessageID) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if h.slog != nil {
+		sl.InfoContext(ctx, "SNS message",
+			slog.String("type", sns.Type),
+			slog.String("message_id", sns.MessageID),
+			slog.String("topic", sns.TopicArn),
+			slog.String("timestamp", sns.Timestamp))
+	}
+	if hdrType != "" && hdrType != sns.Type {
+		sl.WarnContext(ctx, "X-Amz-Sns-Message-Type header does not match message type",
+			slog.String("header", hdrType), slog.String("type", sns.Type))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if !h.topicAllowed(sns.TopicArn) {
+		sl.WarnContext(ctx, "message from unexpected topic", slog.String("topic", sns.TopicArn))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if h.maxAge > 0 {
+		if ts, err := time.Parse(time.RFC3339, sns.Timestamp); err != nil || time.Since(ts) > h.maxAge {
+			sl.WarnContext(ctx, "rejecting stale or undated message", slog.String("timestamp", sns.Timestamp))
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	switch sns.Type {
+	case "SubscriptionConfirmation":
+		if h.confirmRate != nil && !h.confirmRate.Allow() {
+			sl.WarnContext(ctx, "too many subscription confirmations, rejecting one", slog.String("topic", sns.TopicArn))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		if isAWSURL(sns.URL) {
+			sl.InfoContext(ctx, "confirming subscription to topic",
+				slog.String("topic", sns.TopicArn), slog.String("url", sns.URL))
+			if err := h.confirm(ctx, lg, sns.URL); err != nil {
+				// SNS redelivers confirmation message on failure
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "UnsubscribeConfirmation":
+		sl.InfoContext(ctx, "unsubscribed from topic", slog.String("topic", sns.TopicArn))
+		if isAWSURL(sns.UnsubscribeURL) {
+			sl.InfoContext(ctx, "following unsubscribe url", slog.String("url", sns.UnsubscribeURL))
+			if err := h.confirm(ctx, lg, sns.UnsubscribeURL); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "Notification":
+	default:
+		sl.WarnContext(ctx, "unsupported SNS type", slog.String("type", sns.Type))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	h.archive.store(lg, sns.MessageID, body)
+	ev, err := parseSNSNotification(sns, h.fields)
+	if err == nil {
+		err = h.dispatch(lg, ev)
+	}
+	switch err {
+	case nil:
+	case errNoSender:
+		h.forward(lg, body)
+	case errBackPressure:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		sl.ErrorContext(ctx, "processing notification", slog.String("error", err.Error()))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	h.markSeen(lg, sns.MessageID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// submit handles manual submission of a single bounce or complaint, given as
+// json object with "from", "to" and "type" fields, bypassing SNS parsing.
+func (h *handler) submit(lg *log.Logger, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		lg.Print(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Type != "Bounce" && req.Type != "Complaint":
+		http.Error(w, "type should be either Bounce or Complaint", http.StatusBadRequest)
+		return
+	case req.From == "" || req.To == "":
+		http.Error(w, "both from and to should be set", http.StatusBadRequest)
+		return
+	}
+	s, ok := h.lookup(req.From, bounceType(req.Type))
+	if !ok {
+		http.Error(w, errNoSender.Error(), http.StatusNotFound)
+		return
+	}
+	m := &mailInfo{Source: req.From, Timestamp: time.Now()}
+	lg.Printf("%s manually submitted %s", h.tag(m, req.To), strings.ToLower(req.Type))
+	if err := h.enqueue(lg, s, m, req.To, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestID returns request id set by proxy in X-Request-ID or
+// X-Correlation-ID header, or generates a random one
+func requestID(r *http.Request) string {
+	for _, k := range [...]string{"X-Request-ID", "X-Correlation-ID"} {
+		if id := r.Header.Get(k); id != "" && len(id) <= 128 {
+			return id
+		}
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// withPrefix returns logger writing to the same destination as l, with
+// prefix added after the timestamp
+func withPrefix(l *log.Logger, prefix string) *log.Logger {
+	return log.New(l.Writer(), l.Prefix()+prefix, l.Flags()|log.Lmsgprefix)
+}
+
+// topicAllowed reports whether messages from given SNS topic are accepted
+func (h *handler) topicAllowed(arn string) bool {
+	if len(h.topics) == 0 {
+		return true
+	}
+	_, ok := h.topics[arn]
+	return ok
+}
+
+// notify processes SES notification carried in the SNS message, queueing its
+// recipients for blacklisting. It returns errNoSender if no blacklister is
+// registered for message sender, other errors mean message is malformed.
+func (h *handler) notify(lg *log.Logger, message string) error {
+	ev, err := parseNotification(message, h.fields)
+	if err != nil {
+		return err
+	}
+	return h.dispatch(lg, ev)
+}
+
+// dispatch queues recipients of ev to blacklisters of its sender, or holds ev
+// to be dispatched later with timestamp ordering. It returns errNoSender if
+// there is no blacklister for bounce or complaint.
+func (h *handler) dispatch(lg *log.Logger, ev *bounceEvent) error {
+	if h.ignored[ev.EventType] {
+		return nil
 	}
-	autoflags.Define(&args)
-	flag.Parse()
-	logger := log.New(os.Stderr, "", log.LstdFlags)
-	creds, err := readConfig(args.Conf)
-	if err != nil {
-		logger.Fatal(err)
+	if h.order == nil || h.sync {
+		return h.dispatchNow(lg, ev)
 	}
-	h := withLog(newHandler(), logger)
-	h = withBasicAuth(h, args.User, args.Pass)
-	for k, v := range creds {
-		f, err := sqlBlacklister(v.DSN, v.Query)
-		if err != nil {
-			logger.Fatalf("DB connection test failed for %q: %v", k, err)
+	// bounceType of Delivery event is deliveryOnly
+	if _, ok := h.route(ev, bounceType(ev.EventType)); !ok || len(ev.Recipients) == 0 {
+		return h.dispatchNow(lg, ev)
+	}
+	h.order.hold(ev)
+	return nil
+}
+
+// dispatchNow is dispatch without timestamp ordering
+func (h *handler) dispatchNow(lg *log.Logger, ev *bounceEvent) error {
+	sender := ev.Sender
+	switch ev.EventType {
+	case "Bounce":
+		h.rates.record(sender, len(ev.Recipients), len(ev.Recipients))
+	case "Complaint":
+	case "Delivery":
+		h.rates.record(sender, len(ev.Recipients), 0)
+		if s, ok := h.route(ev, deliveryOnly); ok {
+			for _, r := range ev.Recipients {
+				if h.sampled() {
+					lg.Printf("%s delivered%s", h.tag(&ev.Mail, r.Email), s.tagInfo())
+				}
+				if err := h.enqueue(lg, s, &ev.Mail, r.Email, r.Reason); err != nil {
+					return err
+				}
+			}
 		}
-		h.Register(k, f)
+		return nil
+	default:
+		lg.Println("unsupported msg.Type:", ev.EventType)
+		return nil
 	}
-	server := &http.Server{
-		Addr:         args.Addr,
-		Handler:      h,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		ErrorLog:     logger,
+	s, ok := h.route(ev, bounceType(ev.EventType))
+	if !ok {
+		lg.Println("unconfigured sender:", h.pii(sender))
+		return errNoSender
+	}
+	if h.logSample < 1 {
+		defer lg.Printf("%s from %q: %d recipients%s", strings.ToLower(ev.EventType), h.pii(sender),
+			len(ev.Recipients), ev.Mail.destinationInfo())
+	}
+	for _, r := range ev.Recipients {
+		if ev.EventType == "Bounce" {
+			if h.sampled() {
+				lg.Printf("%s, reason: %q%s%s%s", h.tag(&ev.Mail, r.Email), r.Reason,
+					ev.Mail.destinationInfo(), ev.Mail.headerInfo(), s.tagInfo())
+			}
+			h.cw.add(sender, "BounceCount", s.tags)
+			h.publishBounce(lg, bouncedEmail{
+				Sender:     sender,
+				Email:      r.Email,
+				Diagnostic: r.Reason,
+				Timestamp:  ev.Timestamp,
+			})
+			if err := h.enqueue(lg, s, &ev.Mail, r.Email, r.Reason); err != nil {
+				return err
+			}
+			continue
+		}
+		if h.sampled() {
+			lg.Printf("%s complaint reason: %q arrived:%s agent:%q%s%s%s",
+				h.tag(&ev.Mail, r.Email), r.Reason,
+				ev.ArrivalDate.Format(time.RFC3339), ev.UserAgent,
+				ev.Mail.destinationInfo(), ev.Mail.headerInfo(), s.tagInfo())
+		}
+		if r.Reason == string(notSpamOnly) {
+			if ns, ok := h.route(ev, notSpamOnly); ok {
+				if err := h.enqueue(lg, ns, &ev.Mail, r.Email, r.Reason); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		cev := complaintEvent{
+			Sender:       sender,
+			Email:        r.Email,
+			FeedbackType: r.Reason,
+			ArrivalDate:  ev.ArrivalDate,
+			UserAgent:    ev.UserAgent,
+		}
+		if h.onComplaint != nil {
+			h.onComplaint(cev)
+		}
+		h.publishComplaint(lg, cev)
+		h.cw.add(sender, "ComplaintCount", s.tags)
+		if err := h.enqueue(lg, s, &ev.Mail, r.Email, r.Reason); err != nil {
+			return err
+		}
 	}
-	logger.Fatal(server.ListenAndServe())
+	if len(ev.Recipients) > 0 {
+		h.cw.addN(sender, "IntendedRecipients", s.tags, float64(len(ev.Mail.Destination)))
+		h.stream.publish(lg, ev, s.tags)
+	}
+	return nil
 }
 
-func sqlBlacklister(dsn, query string) (blacklister, error) {
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nil, err
+// consume processes message received from a queue, which may either be
+// SNS-wrapped SES notification, as delivered to http endpoint, or raw SES
+// notification json.
+func (h *handler) consume(body []byte) error {
+	sns := new(snsMsg)
+	if err := json.Unmarshal(body, sns); err != nil {
+		return err
 	}
-	if err := db.Ping(); err != nil {
-		return nil, err
+	switch sns.Type {
+	case "": // raw SES notification
+		return h.consumeRaw(body)
+	case "Notification":
+		if !h.topicAllowed(sns.TopicArn) {
+			return fmt.Errorf("message from unexpected topic %q", sns.TopicArn)
+		}
+	default:
+		return fmt.Errorf("unsupported SNS type %q", sns.Type)
 	}
-	return func(email string) error {
-		_, err := db.Exec(query, email)
+	if h.duplicate(h.log, sns.MessageID) {
+		return nil
+	}
+	h.archive.store(h.log, sns.MessageID, body)
+	switch err := h.notify(h.log, sns.Message); err {
+	case nil:
+	case errNoSender:
+		h.forward(h.log, body)
+	default:
 		return err
-	}, nil
+	}
+	h.markSeen(h.log, sns.MessageID)
+	return nil
 }
 
-func readConfig(name string) (map[string]cred, error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	var out map[string]cred
-	if err := json.NewDecoder(io.LimitReader(f, 2<<20)).Decode(&out); err != nil {
-		return nil, err
+// consumeRaw is like consume, but only accepts raw SES notification json,
+// as received from SQS queue with SNS raw message delivery. Such messages
+// are archived under SES message id, as they carry no SNS one.
+func (h *handler) consumeRaw(body []byte) error {
+	msg, err := parseRawSQSBody(body, h.fields)
+	if err == nil {
+		h.archive.store(h.log, msg.Mail.MessageID, body)
+		err = h.dispatch(h.log, msg.event())
 	}
-	if len(out) == 0 {
-		return nil, fmt.Errorf("empty config")
+	if err == errNoSender {
+		h.forward(h.log, body)
+		return nil
 	}
-	for k, v := range out {
-		if v.Query == "" || v.DSN == "" {
-			return nil, fmt.Errorf("invalid record for %q, all fields should be non-empty", k)
+	return err
+}
+
+// route returns queue for recipients of ev of given type, trying
+// configuration set of the email first, then its sending account, then its
+// sender
+func (h *handler) route(ev *bounceEvent, typ bounceType) (*queue, bool) {
+	for _, key := range [...]string{
+		configSetPrefix + ev.Mail.configSet(),
+		accountPrefix + ev.Mail.SendingAccountID,
+	} {
+		if key == configSetPrefix || key == accountPrefix {
+			continue
 		}
-		if c := strings.Count(v.Query, "?"); c != 1 {
-			return nil, fmt.Errorf("invalid sql for %q: expected exactly 1 placeholder", k)
+		h.mu.RLock()
+		s, ok := h.m[queueKey{key, typ}]
+		if !ok && !typ.exclusive() {
+			s, ok = h.m[queueKey{key, anyType}]
+		}
+		h.mu.RUnlock()
+		if ok {
+			return s, true
 		}
 	}
-	return out, nil
+	return h.lookup(ev.Sender, typ)
 }
 
-type cred struct {
-	Query string `json:"sql"`
-	DSN   string `json:"dsn"`
+// lookup returns queue of the given sender for notification type, falling
+// back to the first matching sender pattern, then to catch-all one
+func (h *handler) lookup(sender string, typ bounceType) (*queue, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	senders := []string{sender}
+	for _, p := range h.patterns {
+		if ok, _ := filepath.Match(p, sender); ok {
+			senders = append(senders, p)
+		}
+	}
+	senders = append(senders, defaultKey)
+	var keys []queueKey
+	for _, s := range senders {
+		keys = append(keys, queueKey{s, typ})
+		if !typ.exclusive() {
+			keys = append(keys, queueKey{s, anyType})
+		}
+	}
+	for _, k := range keys {
+		if s, ok := h.m[k]; ok {
+			return s, true
+		}
+	}
+	return nil, false
 }
 
-// handler processes SQS+SNS bounce notifications sent to http/https endpoint.
-// It automatically responds to subscribe confirmation SNS calls. Use Register
-// function to add processing for given sender.
-type handler struct {
-	m      map[string]chan string
-	ctx    context.Context
-	cancel context.CancelFunc
-	log    *log.Logger
-
-	user, pass string // credentials for http basic authentication
+// enqueue passes email to sender's blacklister queue without blocking, unless
+// back-pressure is enabled: then it waits for queue to drain and returns
+// errBackPressure if it did not.
+func (h *handler) enqueue(lg *log.Logger, s *queue, m *mailInfo, email, reason string) error {
+	if h.excluded(email) {
+		lg.Printf("%s skipped as excluded", h.tag(m, email))
+		return nil
+	}
+	if h.normalize {
+		email = emailNormalize(email)
+	}
+	if h.canonical != nil {
+		email = canonicalizeEmail(email, h.canonical)
+	}
+	if h.mx != nil {
+		if err := h.mx.check(email); err != nil {
+			lg.Printf("%s skipped as invalid: %v", h.tag(m, email), err)
+			return nil
+		}
+	}
+	item := email
+	if s.withReason {
+		item = reason + reasonSep + email
+	}
+	if s.direct != nil {
+		if err := safeCall(func() error { return s.direct(item) }); err != nil {
+			lg.Printf("%s: %v", h.tag(m, email), err)
+			h.syncErrs = append(h.syncErrs, err)
+			h.reportError(m.Source, email, err)
+			s.stats.add(0, 1, 0)
+			return nil
+		}
+		s.stats.add(1, 0, 0)
+		return nil
+	}
+	if s.disk != nil {
+		if err := s.disk.push(item); err != nil {
+			lg.Printf("bounce queue write: %s: %v", h.tag(m, email), err)
+		}
+		return nil
+	}
+	if h.bpThreshold > 0 && !h.waitDrain(s) {
+		lg.Printf("bounce queue is full, asking to retry later: %s", h.tag(m, email))
+		return errBackPressure
+	}
+	for {
+		select {
+		case s.ch <- item:
+			return nil
+		default:
+		}
+		if h.overflow != dropOldest {
+			lg.Printf("bounce queue overflow: %s", h.tag(m, email))
+			s.stats.add(0, 0, 1)
+			if h.onOverflow != nil {
+				h.onOverflow(m.Source, email)
+			}
+			return nil
+		}
+		select {
+		case old := <-s.ch:
+			lg.Printf("bounce queue overflow, dropped oldest: %q", h.pii(s.email(old)))
+			s.stats.add(0, 0, 1)
+			if h.onOverflow != nil {
+				h.onOverflow(m.Source, s.email(old))
+			}
+		default:
+		}
+	}
 }
 
-// newHandler returns initialized handler
-func newHandler() *handler {
-	ctx, cancel := context.WithCancel(context.Background())
-	return &handler{
-		m:      make(map[string]chan string),
-		ctx:    ctx,
-		cancel: cancel,
-		log:    log.New(ioutil.Discard, "", 0),
+// waitDrain waits up to h.bpWait for s to hold less than h.bpThreshold
+// emails, reporting whether it does
+func (h *handler) waitDrain(s *queue) bool {
+	deadline := time.Now().Add(h.bpWait)
+	for len(s.ch) >= h.bpThreshold {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+	return true
 }
 
-// withLog attaches logger to handler
-func withLog(h *handler, logger *log.Logger) *handler {
-	h.log = logger
-	return h
+// emailNormalize lowercases email and trims surrounding whitespace
+func emailNormalize(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
 }
 
-// withBasicAuth makes handler require basic http authentication
-func withBasicAuth(h *handler, user, pass string) *handler {
-	h.user, h.pass = user, pass
-	return h
-}
+// blacklister is a func blacklisting given email
+type blacklister func(email string) error
 
-// Close signals background goroutines to stop
-func (h *handler) Close() { h.cancel() }
+// batchBlacklister is a func blacklisting given emails at once, for backends
+// with efficient bulk operations
+type batchBlacklister func(emails []string) error
 
-// Register adds given blacklister function as a processor for bounces for
-// emails that were sent from given srcEmail.
-func (h *handler) Register(srcEmail string, f blacklister) {
-	if _, ok := h.m[srcEmail]; ok {
-		panic(fmt.Errorf("handler for sender %q is already registered", srcEmail))
-	}
-	ch := make(chan string, 100)
-	h.m[srcEmail] = ch
-	go func() {
-		for {
-			select {
-			case email := <-ch:
-				if err := f(email); err != nil {
-					h.log.Printf("%q: %v", email, err)
-				}
-			case <-h.ctx.Done():
-				return
+// teeBlacklister returns blacklister calling every one of fs, like for
+// writing to primary database and its analytics copy. All fs are called even
+// if some fail; their errors are logged and returned joined.
+func teeBlacklister(logger *log.Logger, fs ...blacklister) blacklister {
+	return func(email string) error {
+		var errs []error
+		for i, f := range fs {
+			if err := safeCall(func() error { return f(email) }); err != nil {
+				logger.Printf("tee blacklister #%d: %v", i+1, err)
+				errs = append(errs, err)
 			}
 		}
-	}()
+		return errors.Join(errs...)
+	}
 }
 
-// ServeHTTP implements http.Handler interface.
-func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if h.user != "" && h.pass != "" {
-		if u, p, ok := r.BasicAuth(); !ok || u != h.user || p != h.pass {
-			w.Header().Set("WWW-Authenticate", `Basic realm="private"`)
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
+// filterBlacklister returns blacklister passing email to next only if
+// predicate returns true for it, for business rules like never suppressing
+// corporate addresses. Skipped emails are reported as processed.
+func filterBlacklister(predicate func(email string) bool, next blacklister) blacklister {
+	return func(email string) error {
+		if !predicate(email) {
+			return nil
 		}
+		return next(email)
 	}
-	sns := new(snsMsg)
-	if err := json.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(sns); err != nil {
-		h.log.Print(err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
-	switch sns.Type {
-	case "SubscriptionConfirmation":
-		if strings.Contains(sns.URL, "amazonaws.com") {
-			h.log.Printf("following subscribe confirmation url: %q", sns.URL)
-			confirm(sns.URL)
+}
+
+// fallbackBlacklister returns blacklister calling fallback for emails
+// primary failed on, like for failing over to secondary database
+func fallbackBlacklister(primary, fallback blacklister) blacklister {
+	return func(email string) error {
+		if err := primary(email); err == nil {
+			return nil
 		}
-		w.WriteHeader(http.StatusNoContent)
-		return
-	case "Notification":
-	default:
-		h.log.Printf("unsupported SNS type %q", sns.Type)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+		return fallback(email)
 	}
+}
 
-	var msg payload
-	if err := json.Unmarshal([]byte(sns.Message), &msg); err != nil {
-		h.log.Print(err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
-	switch msg.Type {
-	case "Bounce", "Complaint":
-	default:
-		h.log.Println("unsupported msg.Type:", msg.Type)
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-	sender := msg.Mail.Source
-	ch, ok := h.m[sender]
-	if !ok {
-		ch, ok = h.m[defaultKey]
-	}
-	if !ok {
-		h.log.Println("unconfigured sender:", sender)
-		w.WriteHeader(http.StatusNoContent)
-		return
+// weightedBlacklister returns blacklister passing each email to one of fs
+// chosen at random according to weights, like for sending small fraction of
+// emails to a new database during migration. Weights must sum to 1.
+func weightedBlacklister(weights []float64, fs []blacklister) (blacklister, error) {
+	if len(weights) != len(fs) || len(fs) == 0 {
+		return nil, fmt.Errorf("got %d weights for %d blacklisters", len(weights), len(fs))
 	}
-	if msg.Bounce != nil && msg.Bounce.Type == "Permanent" {
-		for _, r := range msg.Bounce.Recipients {
-			h.log.Printf("from:%q to:%q, reason: %q", sender, r.Email, r.Diagnostic)
-			select {
-			case ch <- r.Email:
-			default:
-				h.log.Printf("bounce queue overflow: from:%q to:%q",
-					sender, r.Email)
-			}
+	var sum float64
+	for _, w := range weights {
+		if w < 0 {
+			return nil, fmt.Errorf("negative weight %v", w)
 		}
+		sum += w
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		return nil, fmt.Errorf("weights sum to %v instead of 1", sum)
 	}
-	if msg.Complaint != nil {
-		for _, r := range msg.Complaint.Recipients {
-			h.log.Printf("from:%q to:%q complaint reason: %q", sender, r.Email, r.Feedback)
-			select {
-			case ch <- r.Email:
-			default:
-				h.log.Printf("bounce queue overflow: from:%q to:%q",
-					sender, r.Email)
+	return func(email string) error {
+		x := mathrand.Float64()
+		for i, w := range weights {
+			if x < w {
+				return fs[i](email)
 			}
+			x -= w
 		}
-	}
-	w.WriteHeader(http.StatusNoContent)
+		return fs[len(fs)-1](email) // rounding errors
+	}, nil
 }
 
-// blacklister is a func blacklisting given email
-type blacklister func(email string) error
+// middleware wraps blacklister to add processing around its calls
+type middleware func(next blacklister) blacklister
 
 // snsMsg represents bounce notification from AWS SNS
 // https://docs.aws.amazon.com/ses/latest/DeveloperGuide/notification-contents.html
 type snsMsg struct {
-	Type    string `json:"Type"` // interested in SubscriptionConfirmation, Notification
-	URL     string `json:"SubscribeURL"`
-	Message string `json:"Message"` // json put into string (sic!)
+	Type           string `json:"Type"` // interested in SubscriptionConfirmation, Notification
+	MessageID      string `json:"MessageId"`
+	TopicArn       string `json:"TopicArn"`
+	URL            string `json:"SubscribeURL"`
+	UnsubscribeURL string `json:"UnsubscribeURL"`
+	Timestamp      string `json:"Timestamp"` // RFC 3339
+	Message        string `json:"Message"`   // json put into string (sic!)
 }
 
 type payload struct {
 	// Possible values are Bounce, Complaint, or Delivery
-	Type string `json:"notificationType"`
-	Mail struct {
-		Source string `json:"source"`
-	} `json:"mail"`
+	Type   string   `json:"notificationType"`
+	Mail   mailInfo `json:"mail"`
 	Bounce *struct {
 		Type       string `json:"bounceType"` // interested in Permanent value only
 		Recipients []struct {
 			Email      string `json:"emailAddress"`
 			Diagnostic string `json:"diagnosticCode"`
 		} `json:"bouncedRecipients,omitempty"`
+		Timestamp time.Time `json:"timestamp"`
 	} `json:"bounce,omitempty"`
 	Complaint *struct {
 		Recipients []struct {
 			Email    string `json:"emailAddress"`
 			Feedback string `json:"complaintFeedbackType"`
 		} `json:"complainedRecipients,omitempty"`
+		Feedback    string    `json:"complaintFeedbackType"`
+		ArrivalDate time.Time `json:"arrivalDate"` // when ISP received complaint
+		UserAgent   string    `json:"userAgent"`   // of the ISP feedback loop
+		Timestamp   time.Time `json:"timestamp"`
 	} `json:"complaint,omitempty"`
+	Delivery *struct {
+		Recipients []string  `json:"recipients"`
+		Timestamp  time.Time `json:"timestamp"`
+	} `json:"delivery,omitempty"`
+}
+
+// mailInfo describes original email the notification is about
+type mailInfo struct {
+	Source    string    `json:"source"`
+	Timestamp time.Time `json:"timestamp"`
+	MessageID string    `json:"messageId"` // assigned by SES
+	Headers   []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"headers"` // only present if enabled for notification topic
+
+	ConfigurationSet string              `json:"configurationSet"`
+	Tags             map[string][]string `json:"tags"` // may hold configuration set too
+
+	SendingAccountID string `json:"sendingAccountId"` // AWS account that sent email
+
+	Destination []string `json:"destination"` // all recipients of the email
+}
+
+// destinationInfo returns number of intended recipients of email formatted
+// for log line, or empty string if unknown
+func (m *mailInfo) destinationInfo() string {
+	if len(m.Destination) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" intended_recipients:%d", len(m.Destination))
+}
+
+// configSet returns name of SES configuration set email was sent with
+func (m *mailInfo) configSet() string {
+	if m.ConfigurationSet != "" {
+		return m.ConfigurationSet
+	}
+	if v := m.Tags["ses:configuration-set"]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// headerInfo returns Message-ID, Subject and X-Mailer headers of original
+// email formatted for log line, or empty string if none are known
+func (m *mailInfo) headerInfo() string {
+	var b strings.Builder
+	for _, name := range [...]string{"Message-ID", "Subject", "X-Mailer"} {
+		for _, hdr := range m.Headers {
+			if strings.EqualFold(hdr.Name, name) {
+				fmt.Fprintf(&b, " %s:%q", strings.ToLower(name), hdr.Value)
+				break
+			}
+		}
+	}
+	return b.String()
+}
+
+// tag returns log line prefix identifying email sent to given recipient
+func (h *handler) tag(m *mailInfo, to string) string {
+	return fmt.Sprintf("from:%q to:%q msgid:%q sent:%s", h.pii(m.Source), h.pii(to),
+		m.MessageID, m.Timestamp.Format(time.RFC3339))
 }
 
 func init() {
@@ -277,22 +2992,90 @@ func init() {
 	}
 }
 
-// confirm issues single GET request to a given url without reading response
-// body. Used to call subscribe confirmation urls
-func confirm(link string) error {
-	r, err := http.Get(link)
-	if err != nil {
-		return err
+// confirm issues GET request to a given url and logs the outcome. Failed
+// requests and ones answered with 5xx status are retried up to
+// confirmAttempts times in total with exponential backoff, while deadline of
+// ctx and confirm budget of handler leave time for the next attempt. Used to
+// call subscribe confirmation urls. Small response body is read and
+// discarded so that connection can be reused.
+func (h *handler) confirm(ctx context.Context, lg *log.Logger, link string) error {
+	get := func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+		if err != nil {
+			return err
+		}
+		r, err := h.confirmClient.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, io.LimitReader(r.Body, 64<<10))
+		r.Body.Close()
+		if r.StatusCode >= 500 {
+			return fmt.Errorf("unexpected response status: %s", r.Status)
+		}
+		lg.Printf("confirmation url responded with %s", r.Status)
+		return nil
+	}
+	if h.confirmBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.confirmBudget)
+		defer cancel()
+	}
+	delay := confirmBackoff
+	for attempt := 1; ; attempt++ {
+		err := get()
+		if err == nil {
+			return nil
+		}
+		// retry only if request context, like one of http.TimeoutHandler,
+		// leaves time for it
+		deadline, ok := ctx.Deadline()
+		if attempt == confirmAttempts || ctx.Err() != nil || ok && time.Until(deadline) < delay {
+			lg.Printf("confirmation url request failed after %d attempts: %v", attempt, err)
+			return err
+		}
+		lg.Printf("confirmation url request attempt %d failed, retrying in %v: %v", attempt, delay, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay *= 2
 	}
-	r.Body.Close()
-	return nil
 }
 
-const defaultKey = "*"
+// confirmAttempts limits number of requests confirm makes, confirmBackoff is
+// delay before the first retry
+const (
+	confirmAttempts = 5
+	confirmBackoff  = time.Second
+)
+
+// defaultKey is the key of catch-all sender record, can be changed with
+// -default-key flag
+var defaultKey = "*"
+
+// configSetPrefix prefixes handler keys of configuration set blacklisters,
+// so that they cannot clash with sender ones
+const configSetPrefix = "configuration-set:"
+
+// accountPrefix prefixes handler keys of blacklisters registered for AWS
+// account sending emails
+const accountPrefix = "account:"
+
+// submitPath is where handler accepts manually submitted bounces, see submit
+// method
+const submitPath = "/submit"
+
+var errNoSender = errors.New("unconfigured sender")
+
+// errBackPressure is returned when queue did not drain in time to accept email
+var errBackPressure = errors.New("queue is full, retry later")
+
+const envPrefix = "BOUNCE_SENDER_"
 
 const aboutFormat = `
 Configuration file should be in json format, it is a mapping between sender
-emails and objects with two fields:
+emails and objects with the following fields:
 
 dsn — MySQL Data Source Name in the following format:
 
@@ -301,6 +3084,91 @@ dsn — MySQL Data Source Name in the following format:
 sql — MySQL query with single ? placeholder that will be replaced by recipient's
 email from the bounce notification.
 
+mode — optional, either "exec" (default) to run sql as is, or "upsert" to
+have sql in "insert into table (columns...) values (...)" form automatically
+extended with "on duplicate key update" clause refreshing all inserted columns,
+so that repeated bounces update existing rows; this fits soft-delete schemas
+where e.g. unsubscribed_at column is set instead of deleting the record:
+
+	"sql": "insert into unsubscribed (email, unsubscribed_at) values (?, now())",
+	"mode": "upsert"
+
+complaint_sql — optional query with single ? placeholder used for complaints
+instead of sql, i.e. to mark complained users differently from bounced ones.
+
+pass_bounce_type — optional, if true, sql (and complaint_sql) should have two
+? placeholders: second one receives notification type, "Bounce" or
+"Complaint", for schemas storing suppression reason alongside email:
+
+	"sql": "insert into suppressed (email, reason) values (?, ?)",
+	"pass_bounce_type": true
+
+pass_complaint_type — optional, if true, complaint_sql (which is then
+required) should have two ? placeholders: first one receives complaint
+feedback type reported by ISP, like "abuse", second one receives email:
+
+	"complaint_sql": "update users set complaint_reason=?, suppressed=1 where email=?",
+	"pass_complaint_type": true
+
+pass_bounce_type and pass_complaint_type cannot be used together.
+
+driver — optional placeholder style of sql and complaint_sql: "mysql"
+(default) for ? placeholders, "postgres" for $1, $2, ... or "oracle" for
+:1, :2, ..., so that queries written for these databases can be reused.
+Numbered placeholders are rewritten to ? ones at startup and the same one may
+be used several times:
+
+	"sql": "insert into suppressed (email, reason) values ($1, $2) on duplicate key update reason=$2",
+	"pass_bounce_type": true,
+	"driver": "postgres"
+
+Placeholders are found by plain text search, so ones inside string literals
+are counted too.
+
+max_open_conns, max_idle_conns, conn_max_lifetime, conn_max_idle_time —
+optional database connection pool settings, defaults are 5, 2, "5m" and "5m"
+respectively; negative values remove the limit. Keep conn_max_idle_time below
+MySQL wait_timeout, which is often set to 60-600 seconds on cloud instances,
+so that idle connections are recycled before server closes them.
+
+dial_timeout, read_timeout — optional MySQL connection and read timeouts,
+like "5s"; they override timeout and readTimeout parameters of the DSN.
+
+Instead of dsn you may set dsn_file — path to a file holding DSN, like a
+mounted Kubernetes secret; it is read once at startup, surrounding whitespace
+is trimmed.
+
+iam_auth — optional, if true, RDS IAM authentication token is generated and
+used instead of password from dsn, which should then have no password; tokens
+are regenerated every 10 minutes, AWS credentials and region are taken from
+the environment. TLS is enabled unless dsn sets tls parameter.
+
+Any record may also have "tags" object of string values, like {"env":"prod",
+"team":"marketing"}: tags are appended to log lines about this record's
+emails and published as additional dimensions of CloudWatch metrics.
+
+Instead of dsn you may also set dsn_secret — name or ARN of the AWS Secrets Manager
+secret holding DSN as its string value; names prefixed with "ssm:" are read
+from SSM Parameter Store instead (e.g. "ssm:/bounces/news/dsn"). Secrets are
+fetched at startup and then re-read every -secret-refresh-interval; AWS
+credentials and region are taken from the environment.
+
+type — optional, "mysql" (default), "mongo", "sqlite" or "noop", the latter
+only with -dry-run. Records of "mongo" type have no dsn and sql fields,
+instead they have uri (MongoDB connection string), database and collection
+fields; for every bounced email such blacklister upserts a document with
+email in "email" field (override with "field") and current time in
+"suppressed_at" field.
+
+Records of "sqlite" type need no database server: they have path (database
+file) and table fields; the table is created if it does not exist, and every
+bounced email is inserted into it, into "email" column by default (override
+with "field"). This fits development and small deployments.
+
+Records of "noop" type need no other fields and only log emails they would
+suppress; use them to check that SNS can reach the endpoint before database
+is ready. Such records are rejected unless -dry-run flag is set.
+
 Example:
 
 {
@@ -316,5 +3184,165 @@ Example:
 
 You may also optionally have one "catch-all" record in a mapping with key value
 "*": it would be used if sender listed in bounce notification did not match any
-other records.
+other records. Name of this key can be changed with -default-key flag, for
+example to "__default__", so that it cannot be confused with a pattern; "*"
+then becomes an ordinary pattern matching any sender.
+
+Keys may also be sender patterns with filepath.Match syntax, like
+"*@marketing.example.com": if sender has no record of its own, patterns are
+tried in the order they appear in config, before the "*" record.
+
+Top-level "tenants" key defines isolated tenants, for platforms sending email
+on behalf of several customers. Each tenant has its own sender records and
+basic auth credentials replacing -user and -pass, and is served under
+/tenant/<name>/ path, e.g. SNS subscription of "acme" tenant should point at
+http://host:8080/tenant/acme/:
+
+{
+	"tenants": {
+		"acme": {
+			"user": "acme",
+			"pass": "secret",
+			"senders": {
+				"news@acme.example": {
+					"dsn": "user:password@tcp(192.168.0.2:3306)/acme",
+					"sql": "delete from subscribers where email=?"
+				}
+			}
+		}
+	}
+}
+
+If -config is a glob pattern like "configs/*.json", all matching files are
+read and merged; each sender may only be defined in one of them.
+
+With -config-url configuration is fetched over http(s), e.g. from Consul KV or
+S3, and then periodically re-fetched: changed records are applied without
+restart, blacklisters of removed or replaced records finish processing their
+queues before shutting down.
+
+If -config flag is not set and environment has BOUNCE_SENDER_* variables,
+configuration is instead read from the environment: each record is defined by
+a group of BOUNCE_SENDER_<N>_NAME (sender email or -default-key value), BOUNCE_SENDER_<N>_DSN
+and BOUNCE_SENDER_<N>_SQL variables sharing the same <N> suffix.
+
+Bounces can also be submitted manually, bypassing SNS, to test the pipeline or
+to re-process logged ones:
+
+	curl -d '{"from":"news@example.com","to":"user@example.net","type":"Bounce"}' \
+		http://localhost:8080/submit
+
+Health of every database and other backends is reported at /health:
+response is json object mapping checks to "ok" or "fail", with 503 status
+if any check failed. Without credentials required by -user and -pass it
+only reports overall status as {"status":"ok"} or {"status":"fail"}, for
+load balancers. Check results are reused for 5 seconds.
+
+Counters of received SNS messages by type are served at /stats as json, or
+in Prometheus text format at /stats?format=prometheus; a spike of
+SubscriptionConfirmation messages may mean someone tries to subscribe the
+endpoint to foreign topics, use -max-confirmations-per-minute to throttle them.
+Set -metrics-addr to also serve the Prometheus format at /metrics on a
+separate address, without authentication.
+
+Subscription confirmation urls are only followed if they are https urls of
+AWS hosts, redirects are not followed, and server certificate should be
+issued by Amazon certificate authority; use -subscribe-cert-pins to
+additionally require these hosts to present certificate with one of given
+SHA-256 fingerprints. Keep pins up to date with AWS certificate rotation,
+otherwise new subscriptions cannot be confirmed. Failed confirmation
+requests are retried up to 5 times with exponential backoff, within
+-request-timeout; if all of them fail, handler responds with 502 status, so
+that SNS delivers confirmation message again.
+
+/stats also reports per-sender bounce rates over the last 1, 15 and 60
+minutes, as fraction of delivered and bounced emails that bounced; enable
+Delivery notifications on SES side for them to be meaningful. With
+-bounce-rate-alert set, a warning is logged once 15 minute rate of a sender
+exceeds the given fraction. Json output of /stats lists senders with
+registered blacklisters under "senders" key, and numbers of their emails
+processed, failed and dropped since start or the last reset under
+"sender_stats" key.
+
+With -mx-validation-timeout set, emails are only blacklisted if their domain
+has MX records: emails of domains without them, or which could not be
+resolved within the timeout, are logged and skipped. Such negative results
+are cached per domain for the same timeout. In containers with custom DNS
+setup, set -mx-dns-server, like 10.0.0.2:53, to send MX queries to that
+server directly.
+
+With -forward-sns-topic set, every processed bounce and complaint is also
+published to the given SNS topic as json object with type, sender,
+recipients (email and reason), messageId, configurationSet, timestamp and
+tags fields, so that analytics pipelines can consume them independently.
+
+For zero-downtime restarts the listening socket can be inherited from parent
+process, such as a process supervisor: if BOUNCE_LISTENER_FD environment
+variable is set, file descriptor of this number is used as listener instead
+of -addr or -listen-unix. With systemd socket activation, first passed socket
+has descriptor 3, so set BOUNCE_LISTENER_FD=3 in the service unit.
+
+With -audit-log set, logs of request handling and email processing are
+appended to the given file through a write buffer, which is flushed when
+full and every -audit-log-flush-interval; lines still buffered are lost if
+the process crashes. Startup errors are still written to stderr.
+
+With -log-format=json, logs are written as json lines: request handling logs
+messages with separate attributes, such as request_id, topic or url, and
+every SNS message is logged with its type, message_id, topic and timestamp.
+
+With -mask-emails, senders and recipients are logged as ***@domain; emails
+logged by noop records and errors returned by databases are not masked.
+
+SNS does not guarantee delivery order, so bounce may arrive after a later
+event about the same email. With -ordering-window set, notifications are
+held for this long after arrival and dispatched per sender in order of their
+event timestamps. Held notifications are lost if the process crashes.
+
+With -sqs-queue-url set, notifications are received from SQS queue
+subscribed to SNS topic instead of serving http; set -sqs-raw if raw
+message delivery is enabled for the subscription. Messages that failed to
+process are left in queue, configure its redrive policy to move them to
+dead-letter queue.
+
+To accept notifications of SES-like gateways using different field names,
+set -field-mapping to a json file mapping SES field names to custom ones at
+any nesting level, like {"notificationType": "event_type"}.
+
+With -archive-s3-bucket set, every received SNS notification is stored in
+the bucket as <prefix>/YYYY/MM/DD/<message id>.json, in background and
+regardless of processing outcome; failed writes are only logged. Archived
+notifications can be replayed with -replay-dir. This applies to
+notifications received over http and from every message queue; raw SES
+notifications, as with -sqs-raw, are stored under SES message id.
+
+To replay SNS notifications stored while service was down, save each one as
+a .json file in a directory and run with -replay-dir: files are processed in
+order of their names, blacklisters are called synchronously, and the process
+exits with non-zero status if any file failed.
+
+For local development, -dev flag makes service re-read configuration before
+handling requests, at most once per second, so that edits of mapping.json
+take effect without restart. This is unsafe for production: requests are
+paused while configuration is re-applied, and configuration errors are only
+logged.
+
+With -manage-addr set, management API is served at this address, requests
+should carry -manage-token as "Authorization: Bearer <token>" header:
+
+	GET /config returns json of active sender records, with credentials
+	in their dsn and uri replaced by ***.
+
+	PATCH /senders/{name} with json object holding dsn, sql or both
+	updates these fields of sender record, replacing its blacklister;
+	previous version is kept if new one fails to connect.
+
+	POST /stats/reset resets email counters of all senders reported by
+	/stats, so that they cover interval since the reset.
+
+Changes made through management API are lost on restart and once
+configuration is reloaded from -config-url.
+
+Run "bouncehandler validate [-config file]" to check configuration and
+connectivity to every database without starting the server.
 `
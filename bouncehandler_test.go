@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/artyom/bouncehandler/bouncehandlertest"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// TestConcurrentRegister registers and unregisters blacklisters while
+// notifications for the same senders are being served; run with -race.
+func TestConcurrentRegister(t *testing.T) {
+	h := newHandler()
+	defer h.Close()
+	srv := bouncehandlertest.NewServer(h)
+	defer srv.Close()
+
+	const senders = 10
+	var wg sync.WaitGroup
+	for i := range senders {
+		from := fmt.Sprintf("sender%d@example.com", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if err := h.RegisterFunc(from, func(string) error { return nil }); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := h.Unregister(from); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if err := srv.SendBounce(from, "user@example.net", "Permanent"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := h.RegisteredSenders(); len(got) != 0 {
+		t.Fatalf("senders left registered: %v", got)
+	}
+}
+
+// BenchmarkSenderLookup measures finding blacklister of sender among given
+// number of registered ones, falling back to catch-all key for unknown
+// senders. Baseline on single-core Xeon VM, go1.27, -benchmem:
+//
+//	senders=1/known            510 ns/op    224 B/op    3 allocs/op
+//	senders=1/catch-all        536 ns/op    224 B/op    3 allocs/op
+//	senders=100/known          483 ns/op    224 B/op    3 allocs/op
+//	senders=100/catch-all      434 ns/op    224 B/op    3 allocs/op
+//	senders=1000/known         326 ns/op    224 B/op    3 allocs/op
+//	senders=1000/catch-all     591 ns/op    224 B/op    3 allocs/op
+//	senders=10000/known        616 ns/op    224 B/op    3 allocs/op
+//	senders=10000/catch-all    605 ns/op    224 B/op    3 allocs/op
+//
+// Cost does not depend on number of senders; allocations come from building
+// list of candidate keys.
+func BenchmarkSenderLookup(b *testing.B) {
+	for _, n := range []int{1, 100, 1000, 10000} {
+		h := newHandler()
+		for i := range n {
+			h.Register(fmt.Sprintf("sender%d@example.com", i), func(string) error { return nil })
+		}
+		h.Register(defaultKey, func(string) error { return nil })
+		b.Run(fmt.Sprintf("senders=%d/known", n), func(b *testing.B) {
+			from := fmt.Sprintf("sender%d@example.com", n/2)
+			for b.Loop() {
+				if _, ok := h.lookup(from, bounceOnly); !ok {
+					b.Fatal("sender not found")
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("senders=%d/catch-all", n), func(b *testing.B) {
+			for b.Loop() {
+				if _, ok := h.lookup("unknown@example.com", bounceOnly); !ok {
+					b.Fatal("catch-all not found")
+				}
+			}
+		})
+		h.Close()
+	}
+}
+
+// TestPanickingBlacklister checks that blacklister panic is recovered and
+// its worker keeps processing next emails
+func TestPanickingBlacklister(t *testing.T) {
+	h := newHandler()
+	defer h.Close()
+	srv := bouncehandlertest.NewServer(h)
+	defer srv.Close()
+	calls := make(chan string, 2)
+	h.Register("news@example.com", func(email string) error {
+		calls <- email
+		panic("nil map")
+	})
+	for _, to := range []string{"first@example.net", "second@example.net"} {
+		if err := srv.SendBounce("news@example.com", to, "Permanent"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-calls:
+			if got != to {
+				t.Fatalf("blacklister called with %q, want %q", got, to)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("blacklister was not called for %q", to)
+		}
+	}
+	waitFor(t, "both panics counted as errors", func() bool {
+		return h.senderCounts()["news@example.com"].Errors == 2
+	})
+}
+
+// waitFor fails test if cond does not become true within a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// TestUnregisterStopsWorker checks that Unregister and Close stop worker
+// goroutines, and that Unregister releases blacklister resources
+func TestUnregisterStopsWorker(t *testing.T) {
+	h := newHandler()
+	defer h.Close()
+	before := runtime.NumGoroutine()
+	var closed atomic.Int32
+	for i := range 5 {
+		key := queueKey{fmt.Sprintf("sender%d@example.com", i), anyType}
+		closer := closerFunc(func() error { closed.Add(1); return nil })
+		if err := h.register(key, func(string) error { return nil }, closer, queueOpts{}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := runtime.NumGoroutine(); n < before+5 {
+		t.Fatalf("got %d goroutines after registering 5 senders, want at least %d", n, before+5)
+	}
+	for i := range 5 {
+		if err := h.Unregister(fmt.Sprintf("sender%d@example.com", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := closed.Load(); n != 5 {
+		t.Fatalf("%d of 5 blacklister resources closed", n)
+	}
+	waitFor(t, "workers to exit after Unregister", func() bool { return runtime.NumGoroutine() <= before })
+
+	h.Register("news@example.com", func(string) error { return nil })
+	h.Close()
+	waitFor(t, "worker to exit after Close", func() bool { return runtime.NumGoroutine() <= before })
+}
+
+// TestChannelOverflow sends notifications concurrently to sender whose
+// blacklister is blocked and whose queue holds single email, checking that
+// queue never holds more than that, overflows are logged and reported to
+// hook, and every request is still acknowledged with 204
+func TestChannelOverflow(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var logs lockedBuffer
+		var overflows, calls atomic.Int32
+		var s *queue
+		h := withLog(newHandler(), log.New(&logs, "", 0))
+		h = withChannelSize(h, 1)
+		h = withOverflowHook(h, func(sender, email string) {
+			overflows.Add(1)
+			if n := len(s.ch); n > 1 {
+				t.Errorf("queue holds %d emails on overflow, want at most 1", n)
+			}
+		})
+		release := make(chan struct{})
+		h.Register("news@example.com", func(string) error {
+			calls.Add(1)
+			<-release
+			return nil
+		})
+		s, _ = h.lookup("news@example.com", bounceOnly)
+
+		const requests, recipients = 100, 3
+		var wg sync.WaitGroup
+		for i := range requests {
+			body := bounceBody(t, "news@example.com", recipients, i)
+			wg.Go(func() {
+				r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+				r.Header.Set("X-Amz-Sns-Message-Type", "Notification")
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != http.StatusNoContent {
+					t.Errorf("got %d response status, want 204", w.Code)
+				}
+				if n := len(s.ch); n > 1 {
+					t.Errorf("queue holds %d emails while requests are served, want at most 1", n)
+				}
+			})
+		}
+		wg.Wait()
+		synctest.Wait()
+		if len(s.ch) != 1 {
+			t.Fatalf("queue holds %d emails, want it full at 1", len(s.ch))
+		}
+		if got := int(calls.Load()) + len(s.ch) + int(overflows.Load()); got != requests*recipients {
+			t.Fatalf("%d emails are either queued, processed or dropped, want %d", got, requests*recipients)
+		}
+		if want := requests*recipients - cap(s.ch) - 1; int(overflows.Load()) < want {
+			t.Fatalf("%d emails dropped, want at least %d", overflows.Load(), want)
+		}
+		if got := strings.Count(logs.String(), "bounce queue overflow"); got != int(overflows.Load()) {
+			t.Fatalf("got %d overflow log lines for %d dropped emails", got, overflows.Load())
+		}
+		close(release)
+		synctest.Wait()
+		if got := int(calls.Load()) + int(overflows.Load()); got != requests*recipients {
+			t.Fatalf("%d emails processed or dropped after release, want %d", got, requests*recipients)
+		}
+		h.Close()
+		synctest.Wait()
+	})
+}
+
+// bounceBody returns SNS notification about permanent bounce of n
+// recipients of email from sender
+func bounceBody(t testing.TB, from string, n, seq int) []byte {
+	t.Helper()
+	var rcpts []map[string]string
+	var to []string
+	for i := range n {
+		email := fmt.Sprintf("user%d.%d@example.net", seq, i)
+		to = append(to, email)
+		rcpts = append(rcpts, map[string]string{"emailAddress": email})
+	}
+	body, err := bouncehandlertest.Wrap(map[string]any{
+		"notificationType": "Bounce",
+		"mail":             map[string]any{"source": from, "destination": to},
+		"bounce":           map[string]any{"bounceType": "Permanent", "bouncedRecipients": rcpts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// lockedBuffer is bytes.Buffer safe for concurrent use by several loggers
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// BenchmarkServeHTTP measures serving SNS notification with single bounced
+// recipient: body decoding, SNS type switch, payload parsing and queueing
+// email to blacklister which never blocks. Run with -benchmem to track
+// allocations. Baseline on single-core Xeon VM, go1.27:
+//
+//	BenchmarkServeHTTP    20092 ns/op    10208 B/op    75 allocs/op
+func BenchmarkServeHTTP(b *testing.B) {
+	h := newHandler()
+	defer h.Close()
+	sink := make(chan string, 1000)
+	h.Register("news@example.com", func(email string) error {
+		select {
+		case sink <- email:
+		default:
+		}
+		return nil
+	})
+	body := bounceBody(b, "news@example.com", 1, 0)
+	b.ReportAllocs()
+	for b.Loop() {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		r.Header.Set("X-Amz-Sns-Message-Type", "Notification")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			b.Fatalf("got %d response status, want 204", w.Code)
+		}
+	}
+}
+
+// TestCloseTwice checks that Close and CloseWithTimeout can be called
+// several times and in any order; run with -race
+func TestCloseTwice(t *testing.T) {
+	h := newHandler()
+	h.Register("news@example.com", func(string) error { return nil })
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(h.Close)
+		wg.Go(func() {
+			if err := h.CloseWithTimeout(time.Second); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	if err := h.Err(); err != errClosed {
+		t.Fatalf("got %v Err after close, want %v", err, errClosed)
+	}
+
+	h = newHandler()
+	h.Register("news@example.com", func(string) error { return nil })
+	if err := h.CloseWithTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.CloseWithTimeout(time.Second); err != nil {
+		t.Fatalf("second CloseWithTimeout: %v", err)
+	}
+	h.Close()
+	if got := h.RegisteredSenders(); len(got) != 0 {
+		t.Fatalf("senders left registered after CloseWithTimeout: %v", got)
+	}
+}
+
+// TestConfirmTransportTLSConfig checks that transport with its own TLS
+// config still only accepts certificates issued by Amazon, keeping settings
+// and VerifyConnection callback of that config
+func TestConfirmTransportTLSConfig(t *testing.T) {
+	var called int
+	orig := &tls.Config{
+		MinVersion:       tls.VersionTLS13,
+		VerifyConnection: func(tls.ConnectionState) error { called++; return nil },
+	}
+	tr := &http.Transport{TLSClientConfig: orig}
+	h := withConfirmTransport(newHandler(), tr)
+	defer h.Close()
+	cfg := h.confirmClient.Transport.(*http.Transport).TLSClientConfig
+	if cfg == orig {
+		t.Fatal("TLS config of transport was modified in place")
+	}
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("got %x MinVersion, want TLS 1.3 one of original config", cfg.MinVersion)
+	}
+	chain := func(org string) tls.ConnectionState {
+		return tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+			{Subject: pkix.Name{CommonName: "sns.us-east-1.amazonaws.com"}},
+			{Subject: pkix.Name{Organization: []string{org}}},
+		}}}
+	}
+	if err := cfg.VerifyConnection(chain("Example CA")); err == nil {
+		t.Fatal("certificate not issued by Amazon was accepted")
+	}
+	if called != 0 {
+		t.Fatal("original VerifyConnection called for rejected certificate")
+	}
+	if err := cfg.VerifyConnection(chain("Amazon")); err != nil {
+		t.Fatal(err)
+	}
+	if called != 1 {
+		t.Fatalf("original VerifyConnection called %d times, want 1", called)
+	}
+}
+
+// TestDeduplication checks that SNS message with already processed
+// MessageId is acknowledged without reaching blacklister, even once it is
+// too old to be accepted otherwise, and is processed again after its id
+// expires
+func TestDeduplication(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var calls atomic.Int32
+		h := withDeduplicationCacheSize(newHandler(), 10)
+		h = withDeduplicationTTL(h, time.Hour)
+		h = withMaxMessageAge(h, 10*time.Minute)
+		h.Register("news@example.com", func(string) error { calls.Add(1); return nil })
+		body := bounceBody(t, "news@example.com", 1, 0)
+		post := func() int {
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			return w.Code
+		}
+		for range 2 {
+			if code := post(); code != http.StatusNoContent {
+				t.Fatalf("got %d response status, want 204", code)
+			}
+		}
+		time.Sleep(30 * time.Minute)
+		if code := post(); code != http.StatusNoContent {
+			t.Fatalf("got %d response status for stale duplicate, want 204", code)
+		}
+		synctest.Wait()
+		if n := calls.Load(); n != 1 {
+			t.Fatalf("blacklister called %d times, want 1", n)
+		}
+		time.Sleep(time.Hour)
+		if code := post(); code != http.StatusBadRequest {
+			t.Fatalf("got %d response status for stale message with expired id, want 400", code)
+		}
+		h.Close()
+		synctest.Wait()
+	})
+}
+
+// TestNumberedPlaceholders checks that numbered placeholders are rewritten
+// to ? ones taking arguments in the order they refer to
+func TestNumberedPlaceholders(t *testing.T) {
+	c := cred{
+		Query:          "insert into suppressed (email, reason) values ($1, $2) on duplicate key update reason=$2",
+		Driver:         "postgres",
+		PassBounceType: true,
+		policy:         bounceOnly,
+	}
+	if err := checkPlaceholders(dollar, c.Query, 2); err != nil {
+		t.Fatal(err)
+	}
+	if want := "insert into suppressed (email, reason) values (?, ?) on duplicate key update reason=?"; c.sql() != want {
+		t.Fatalf("got query %q, want %q", c.sql(), want)
+	}
+	got := fmt.Sprint(c.queryArgs().of("user@example.net"))
+	if want := fmt.Sprint([]any{"user@example.net", string(bounceOnly), string(bounceOnly)}); got != want {
+		t.Fatalf("got %s query arguments, want %s", got, want)
+	}
+	for query, want := range map[string]string{
+		"update users set suppressed=1 where email=:2": "placeholders are not numbered from 1 without gaps",
+		"delete from users where email=:0":             `invalid placeholder ":0"`,
+		"delete from users where email=:1 or id=:1":    "",
+	} {
+		err := checkPlaceholders(colon, query, 1)
+		if got := fmt.Sprint(err); err == nil && want != "" || err != nil && got != want {
+			t.Errorf("%q: got %v error, want %q", query, err, want)
+		}
+	}
+}
+
+// TestConfirmBudget checks that confirm stops retrying failed requests once
+// the next retry would not fit into confirm budget
+func TestConfirmBudget(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := withConfirmBudget(newHandler(), 4*time.Second)
+		defer h.Close()
+		var attempts int
+		h.confirmClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			attempts++
+			return &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Status:     "503 Service Unavailable",
+				Body:       http.NoBody,
+				Request:    r,
+			}, nil
+		})
+		start := time.Now()
+		err := h.confirm(t.Context(), log.New(io.Discard, "", 0), "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription")
+		if err == nil {
+			t.Fatal("confirm succeeded with failing requests")
+		}
+		// attempts at 0s, 1s and 3s; retry after 4s more does not fit
+		if attempts != 3 {
+			t.Fatalf("got %d attempts, want 3", attempts)
+		}
+		if d := time.Since(start); d != 3*time.Second {
+			t.Fatalf("confirm took %v, want 3s", d)
+		}
+	})
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// TestCloudWatchFlushOnClose checks that counts collected since the last
+// publish are sent once handler is closed
+func TestCloudWatchFlushOnClose(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		client := &cwRecorder{}
+		h := withCloudWatchMetrics(newHandler(), "Test", client)
+		h.cw.add("news@example.com", "BounceCount", nil)
+		h.cw.add("news@example.com", "BounceCount", nil)
+		h.Close()
+		synctest.Wait()
+		if len(client.data) != 1 || aws.StringValue(client.data[0].MetricName) != "BounceCount" ||
+			aws.Float64Value(client.data[0].Value) != 2 {
+			t.Fatalf("got %v published on close, want BounceCount of 2", client.data)
+		}
+	})
+}
+
+// cwRecorder is CloudWatch client recording published metric data
+type cwRecorder struct {
+	cloudwatchiface.CloudWatchAPI
+	data []*cloudwatch.MetricDatum
+}
+
+func (c *cwRecorder) PutMetricDataWithContext(_ aws.Context, in *cloudwatch.PutMetricDataInput, _ ...request.Option) (*cloudwatch.PutMetricDataOutput, error) {
+	c.data = append(c.data, in.MetricData...)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
@@ -0,0 +1,106 @@
+// Package bouncehandlertest provides utilities to test http handlers of SNS
+// bounce notifications.
+package bouncehandlertest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// Server is a test http server sending SNS-wrapped SES notifications to
+// handler under test
+type Server struct {
+	*httptest.Server
+}
+
+// NewServer starts and returns a new Server serving h. Caller should call
+// Close when finished.
+func NewServer(h http.Handler) *Server {
+	return &Server{httptest.NewServer(h)}
+}
+
+// SendBounce posts notification about bounce of the email from sender to
+// recipient, bounceType is "Permanent", "Transient" or "Undetermined". It
+// returns error if server responded with status other than 204.
+func (s *Server) SendBounce(from, to, bounceType string) error {
+	msg := map[string]any{
+		"notificationType": "Bounce",
+		"mail":             mail(from, to),
+		"bounce": map[string]any{
+			"bounceType": bounceType,
+			"bouncedRecipients": []map[string]string{{
+				"emailAddress":   to,
+				"diagnosticCode": "smtp; 550 5.1.1 user unknown",
+			}},
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	return s.send(msg)
+}
+
+// SendComplaint posts notification about complaint on the email from sender
+// to recipient, feedbackType is like "abuse" or "not-spam". It returns error
+// if server responded with status other than 204.
+func (s *Server) SendComplaint(from, to, feedbackType string) error {
+	msg := map[string]any{
+		"notificationType": "Complaint",
+		"mail":             mail(from, to),
+		"complaint": map[string]any{
+			"complainedRecipients":  []map[string]string{{"emailAddress": to}},
+			"complaintFeedbackType": feedbackType,
+			"timestamp":             time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	return s.send(msg)
+}
+
+func (s *Server) send(msg any) error {
+	body, err := Wrap(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+	req.Header.Set("X-Amz-Sns-Message-Type", "Notification")
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// Wrap returns SNS Notification envelope, as delivered to http subscribers,
+// with json of msg as its Message
+func Wrap(msg any) ([]byte, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]string{
+		"Type":      "Notification",
+		"MessageId": fmt.Sprintf("%x", time.Now().UnixNano()),
+		"TopicArn":  "arn:aws:sns:us-east-1:123456789012:bounces",
+		"Message":   string(b),
+		"Timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+func mail(from string, to ...string) map[string]any {
+	return map[string]any{
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"messageId":   fmt.Sprintf("%x", time.Now().UnixNano()),
+		"source":      from,
+		"destination": to,
+	}
+}
@@ -0,0 +1,196 @@
+package bouncehandlertest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// Signer signs SNS envelopes with a test RSA key, serving its self-signed
+// certificate over http as SigningCertURL
+type Signer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+// NewSigner generates a new key and starts serving its certificate. Caller
+// should call Close when finished.
+func NewSigner() (*Signer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(cert)
+	}))
+	return &Signer{Server: srv, key: key}, nil
+}
+
+// CertURL returns url of the certificate, as set in SigningCertURL
+func (s *Signer) CertURL() string { return s.URL + "/SimpleNotificationService.pem" }
+
+// sign sets SignatureVersion, SigningCertURL and Signature fields of SNS
+// Notification envelope, signing its canonical form with SHA256
+func (s *Signer) sign(env map[string]string) error {
+	var b strings.Builder
+	for _, k := range [...]string{"Message", "MessageId", "Subject", "Timestamp", "TopicArn", "Type"} {
+		if v, ok := env[k]; ok {
+			b.WriteString(k + "\n" + v + "\n")
+		}
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return err
+	}
+	env["SignatureVersion"] = "2"
+	env["SigningCertURL"] = s.CertURL()
+	env["Signature"] = base64.StdEncoding.EncodeToString(sig)
+	return nil
+}
+
+// NotificationBuilder constructs signed SNS envelopes with SES bounce or
+// complaint notification. Methods return the builder itself, so calls can
+// be chained; errors are reported by Build.
+type NotificationBuilder struct {
+	signer *Signer
+	sender string
+
+	bounceType, bounceSubType string
+	bounces                   []string
+	feedbackType              string
+	complaints                []string
+
+	err error
+}
+
+// NewNotificationBuilder returns builder of envelopes signed by s
+func NewNotificationBuilder(s *Signer) *NotificationBuilder {
+	return &NotificationBuilder{signer: s}
+}
+
+// WithSender sets source email of the notified email
+func (b *NotificationBuilder) WithSender(from string) *NotificationBuilder {
+	b.sender = from
+	return b
+}
+
+// AddBounce adds recipient to bounce notification, bounceType is
+// "Permanent", "Transient" or "Undetermined", subType is like "General" or
+// "NoEmail". All bounced recipients of a notification share the same types.
+func (b *NotificationBuilder) AddBounce(to, bounceType, subType string) *NotificationBuilder {
+	if len(b.bounces) != 0 && (bounceType != b.bounceType || subType != b.bounceSubType) {
+		b.setErr(errors.New("bounced recipients of different types"))
+	}
+	b.bounceType, b.bounceSubType = bounceType, subType
+	b.bounces = append(b.bounces, to)
+	return b
+}
+
+// AddComplaint adds recipient to complaint notification, feedbackType is like
+// "abuse" or "not-spam"
+func (b *NotificationBuilder) AddComplaint(to, feedbackType string) *NotificationBuilder {
+	if len(b.complaints) != 0 && feedbackType != b.feedbackType {
+		b.setErr(errors.New("complained recipients of different feedback types"))
+	}
+	b.feedbackType = feedbackType
+	b.complaints = append(b.complaints, to)
+	return b
+}
+
+func (b *NotificationBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Build returns signed SNS Notification envelope. Notification should have
+// sender and either bounced or complained recipients, but not both.
+func (b *NotificationBuilder) Build() ([]byte, error) {
+	switch {
+	case b.err != nil:
+		return nil, b.err
+	case b.sender == "":
+		return nil, errors.New("sender is not set")
+	case len(b.bounces) == 0 && len(b.complaints) == 0:
+		return nil, errors.New("no recipients added")
+	case len(b.bounces) != 0 && len(b.complaints) != 0:
+		return nil, errors.New("notification cannot have both bounces and complaints")
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	var msg map[string]any
+	if len(b.bounces) != 0 {
+		var rcpts []map[string]string
+		for _, to := range b.bounces {
+			rcpts = append(rcpts, map[string]string{
+				"emailAddress":   to,
+				"diagnosticCode": "smtp; 550 5.1.1 user unknown",
+			})
+		}
+		msg = map[string]any{
+			"notificationType": "Bounce",
+			"mail":             mail(b.sender, b.bounces...),
+			"bounce": map[string]any{
+				"bounceType":        b.bounceType,
+				"bounceSubType":     b.bounceSubType,
+				"bouncedRecipients": rcpts,
+				"timestamp":         now,
+			},
+		}
+	} else {
+		var rcpts []map[string]string
+		for _, to := range b.complaints {
+			rcpts = append(rcpts, map[string]string{"emailAddress": to})
+		}
+		msg = map[string]any{
+			"notificationType": "Complaint",
+			"mail":             mail(b.sender, b.complaints...),
+			"complaint": map[string]any{
+				"complainedRecipients":  rcpts,
+				"complaintFeedbackType": b.feedbackType,
+				"timestamp":             now,
+			},
+		}
+	}
+	m, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	env := map[string]string{
+		"Type":      "Notification",
+		"MessageId": fmt.Sprintf("%x", time.Now().UnixNano()),
+		"TopicArn":  "arn:aws:sns:us-east-1:123456789012:bounces",
+		"Message":   string(m),
+		"Timestamp": now,
+	}
+	if err := b.signer.sign(env); err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
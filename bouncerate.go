@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// bounceRateWindows are time windows bounce rates are reported for
+var bounceRateWindows = []struct {
+	name    string
+	minutes int
+}{{"1m", 1}, {"15m", 15}, {"1h", 60}}
+
+// alertWindow is the bounceRateWindows index of window checked against
+// alert threshold
+const alertWindow = 1
+
+// bounceRateTracker counts sent and bounced emails per sender in per-minute
+// buckets covering the last hour. Sent emails are those SES reported as
+// delivered or bounced, so rate is only meaningful if SES publishes delivery
+// notifications too. Zero value is ready to use.
+type bounceRateTracker struct {
+	mu       sync.Mutex
+	senders  map[string]*rateRing
+	alerting map[string]bool // senders whose rate is above threshold
+
+	threshold float64
+	hook      func(sender string, rate float64)
+
+	now func() time.Time // if nil, time.Now is used
+}
+
+// rateRing is a ring buffer of per-minute counts, indexed by minute modulo
+// its size
+type rateRing [60]struct {
+	minute        int64 // unix minute bucket counts belong to
+	sent, bounced uint64
+}
+
+// record adds counts for sender, calling alert hook if sender's rate
+// crossed the threshold
+func (t *bounceRateTracker) record(sender string, sent, bounced int) {
+	t.mu.Lock()
+	now := t.clock()
+	if t.senders == nil {
+		t.senders = make(map[string]*rateRing)
+	}
+	r, ok := t.senders[sender]
+	if !ok {
+		r = new(rateRing)
+		t.senders[sender] = r
+	}
+	b := &r[now%int64(len(r))]
+	if b.minute != now {
+		b.minute, b.sent, b.bounced = now, 0, 0
+	}
+	b.sent += uint64(sent)
+	b.bounced += uint64(bounced)
+	if t.hook == nil {
+		t.mu.Unlock()
+		return
+	}
+	rate := r.rate(now, bounceRateWindows[alertWindow].minutes)
+	above := rate > t.threshold
+	fire := above && !t.alerting[sender]
+	if t.alerting == nil {
+		t.alerting = make(map[string]bool)
+	}
+	if above {
+		t.alerting[sender] = true
+	} else {
+		delete(t.alerting, sender)
+	}
+	hook := t.hook
+	t.mu.Unlock()
+	if fire {
+		hook(sender, rate)
+	}
+}
+
+// snapshot returns bounce rates of senders with any emails sent within the
+// last hour, keyed by sender and then by window name. Idle senders are
+// forgotten.
+func (t *bounceRateTracker) snapshot() map[string]map[string]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock()
+	out := make(map[string]map[string]float64, len(t.senders))
+	for sender, r := range t.senders {
+		if !r.active(now) {
+			delete(t.senders, sender)
+			delete(t.alerting, sender)
+			continue
+		}
+		rates := make(map[string]float64, len(bounceRateWindows))
+		for _, w := range bounceRateWindows {
+			rates[w.name] = r.rate(now, w.minutes)
+		}
+		out[sender] = rates
+	}
+	return out
+}
+
+func (t *bounceRateTracker) clock() int64 {
+	now := time.Now
+	if t.now != nil {
+		now = t.now
+	}
+	return now().Unix() / 60
+}
+
+// rate returns fraction of emails bounced within given number of minutes up
+// to and including now
+func (r *rateRing) rate(now int64, minutes int) float64 {
+	var sent, bounced uint64
+	for i := 0; i < minutes; i++ {
+		b := &r[(now-int64(i))%int64(len(r))]
+		if b.minute != now-int64(i) {
+			continue
+		}
+		sent += b.sent
+		bounced += b.bounced
+	}
+	if sent == 0 {
+		return 0
+	}
+	return float64(bounced) / float64(sent)
+}
+
+func (r *rateRing) active(now int64) bool {
+	for i := range r {
+		if now-r[i].minute < int64(len(r)) && r[i].sent > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// withBounceRateAlert makes handler call hook when sender's bounce rate over
+// the last 15 minutes rises above threshold. Hook is called once per
+// crossing, and again only after rate drops back below threshold first.
+func withBounceRateAlert(h *handler, threshold float64, hook func(sender string, rate float64)) *handler {
+	h.rates.mu.Lock()
+	defer h.rates.mu.Unlock()
+	h.rates.threshold, h.rates.hook = threshold, hook
+	return h
+}
+
+// sortedKeys returns keys of m in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
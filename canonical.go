@@ -0,0 +1,51 @@
+package main
+
+import "strings"
+
+// canonicalizationRule tells how local part of addresses of some domain is
+// reduced to the mailbox it is delivered to
+type canonicalizationRule struct {
+	StripDots bool // dots in local part are ignored
+	StripPlus bool // "+tag" suffix of local part is ignored
+}
+
+// gmailRules are canonicalization rules of Gmail domains
+var gmailRules = map[string]canonicalizationRule{
+	"gmail.com":      {StripDots: true, StripPlus: true},
+	"googlemail.com": {StripDots: true, StripPlus: true},
+}
+
+// withCanonicalization makes handler canonicalize emails with rules keyed
+// by lowercase domain before passing them to blacklisters, so that
+// variants of the same mailbox, like john.doe+news@gmail.com and
+// johndoe@gmail.com, are suppressed as one
+func withCanonicalization(h *handler, rules map[string]canonicalizationRule) *handler {
+	h.canonical = rules
+	return h
+}
+
+// canonicalizeEmail returns email with local part reduced according to rule
+// for its domain. Emails of domains without rules are returned as is.
+func canonicalizeEmail(email string, rules map[string]canonicalizationRule) string {
+	i := strings.LastIndexByte(email, '@')
+	if i <= 0 {
+		return email
+	}
+	rule, ok := rules[strings.ToLower(email[i+1:])]
+	if !ok {
+		return email
+	}
+	local, domain := email[:i], email[i:]
+	if rule.StripPlus {
+		if j := strings.IndexByte(local, '+'); j > 0 {
+			local = local[:j]
+		}
+	}
+	if rule.StripDots {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	if local == "" {
+		return email
+	}
+	return local + domain
+}
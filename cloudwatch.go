@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// cwMetrics aggregates per-sender counters and periodically publishes them
+// to CloudWatch. Nil *cwMetrics is valid and discards all counts.
+type cwMetrics struct {
+	namespace string
+	client    cloudwatchiface.CloudWatchAPI
+
+	mu     sync.Mutex
+	counts map[cwKey]float64
+	dims   map[string]map[string]string // tags by their formatTags form
+}
+
+type cwKey struct{ sender, metric, tags string }
+
+func newCWMetrics(namespace string, client cloudwatchiface.CloudWatchAPI) *cwMetrics {
+	return &cwMetrics{
+		namespace: namespace,
+		client:    client,
+		counts:    make(map[cwKey]float64),
+		dims:      make(map[string]map[string]string),
+	}
+}
+
+// add increments named metric for sender, tags are published as additional
+// dimensions
+func (m *cwMetrics) add(sender, metric string, tags map[string]string) {
+	m.addN(sender, metric, tags, 1)
+}
+
+// addN is like add, but increments metric by n
+func (m *cwMetrics) addN(sender, metric string, tags map[string]string, n float64) {
+	if m == nil || n == 0 {
+		return
+	}
+	key := cwKey{sender, metric, formatTags(tags)}
+	m.mu.Lock()
+	m.counts[key] += n
+	m.dims[key.tags] = tags
+	m.mu.Unlock()
+}
+
+// loop publishes collected counts every interval until ctx is canceled, then
+// publishes counts collected since the last time
+func (m *cwMetrics) loop(ctx context.Context, logger *log.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+			defer cancel()
+			if err := m.flush(ctx); err != nil {
+				logger.Printf("cloudwatch metrics: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := m.flush(ctx); err != nil {
+				logger.Printf("cloudwatch metrics: %v", err)
+			}
+		}
+	}
+}
+
+// flush sends collected counts to CloudWatch and resets them. Counts that
+// failed to be sent are lost.
+func (m *cwMetrics) flush(ctx context.Context) error {
+	m.mu.Lock()
+	counts, dims := m.counts, m.dims
+	m.counts = make(map[cwKey]float64)
+	m.dims = make(map[string]map[string]string)
+	m.mu.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+	now := time.Now()
+	data := make([]*cloudwatch.MetricDatum, 0, len(counts))
+	for k, v := range counts {
+		data = append(data, &cloudwatch.MetricDatum{
+			MetricName: aws.String(k.metric),
+			Dimensions: append([]*cloudwatch.Dimension{{
+				Name:  aws.String("Sender"),
+				Value: aws.String(k.sender),
+			}}, tagDimensions(dims[k.tags])...),
+			Timestamp: aws.Time(now),
+			Unit:      aws.String(cloudwatch.StandardUnitCount),
+			Value:     aws.Float64(v),
+		})
+	}
+	const batch = 20 // PutMetricData takes limited number of values per call
+	for len(data) > 0 {
+		n := min(len(data), batch)
+		if _, err := m.client.PutMetricDataWithContext(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(m.namespace),
+			MetricData: data[:n],
+		}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// tagDimensions returns tags as CloudWatch dimensions sorted by name
+func tagDimensions(tags map[string]string) []*cloudwatch.Dimension {
+	var out []*cloudwatch.Dimension
+	for _, name := range sortedKeys(tags) {
+		out = append(out, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(tags[name]),
+		})
+	}
+	return out
+}
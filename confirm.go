@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// newConfirmClient returns client for following subscription confirmation
+// urls: it does not follow redirects, so that confirmation cannot be
+// redirected away from AWS host, and only accepts server certificates
+// issued by Amazon certificate authority. Client is shared by all
+// confirmations and keeps connections to SNS hosts alive, as subscribing
+// many topics at once sends confirmation requests in bursts.
+func newConfirmClient() *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{VerifyConnection: amazonIssued}
+	tr.MaxIdleConnsPerHost = 10
+	tr.MaxConnsPerHost = 50
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: tr,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// withConfirmTransport makes handler follow subscription confirmation urls
+// with given transport, like one with connection limits tuned for the
+// number of topics. TLS config of t is replaced with its copy which, as the
+// default transport does, only accepts certificates issued by Amazon before
+// calling VerifyConnection of t config, if any. Use it before
+// withSubscribeCertPins, which configures the current transport.
+func withConfirmTransport(h *handler, t *http.Transport) *handler {
+	cfg := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		cfg = t.TLSClientConfig.Clone()
+	}
+	if verify := cfg.VerifyConnection; verify != nil {
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if err := amazonIssued(cs); err != nil {
+				return err
+			}
+			return verify(cs)
+		}
+	} else {
+		cfg.VerifyConnection = amazonIssued
+	}
+	t.TLSClientConfig = cfg
+	h.confirmClient.Transport = t
+	return h
+}
+
+// amazonIssued returns error unless verified certificate chain of the
+// connection has intermediate or root certificate of Amazon organization
+func amazonIssued(cs tls.ConnectionState) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, c := range chain[1:] {
+			if slices.Contains(c.Subject.Organization, "Amazon") {
+				return nil
+			}
+		}
+	}
+	return errors.New("server certificate is not issued by Amazon")
+}
+
+// isAWSURL reports whether link is https url of AWS host
+func isAWSURL(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(u.Hostname()), ".amazonaws.com")
+}
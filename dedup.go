@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// idempotencyStore remembers ids of processed messages
+type idempotencyStore interface {
+	// Seen reports whether message with given id was marked and its mark
+	// has not yet expired
+	Seen(id string) (bool, error)
+	// Mark records message id as processed for ttl
+	Mark(id string, ttl time.Duration) error
+}
+
+// duplicate reports whether SNS message with given id was already processed.
+// Store errors are logged and message is treated as a new one.
+func (h *handler) duplicate(lg *log.Logger, id string) bool {
+	if h.seen == nil || id == "" {
+		return false
+	}
+	ok, err := h.seen.Seen(id)
+	if err != nil {
+		lg.Printf("idempotency store: %v", err)
+		return false
+	}
+	if ok {
+		lg.Printf("skipping duplicate message %q", id)
+	}
+	return ok
+}
+
+// markSeen records SNS message with given id as processed
+func (h *handler) markSeen(lg *log.Logger, id string) {
+	if h.seen == nil || id == "" {
+		return
+	}
+	if err := h.seen.Mark(id, h.seenTTL); err != nil {
+		lg.Printf("idempotency store: %v", err)
+	}
+}
+
+// lruStore is in-memory idempotencyStore holding at most size ids, least
+// recently marked ones are evicted first
+type lruStore struct {
+	mu   sync.Mutex
+	size int
+	ll   *list.List // of *lruEntry, most recent at front
+	m    map[string]*list.Element
+}
+
+type lruEntry struct {
+	id      string
+	expires time.Time
+}
+
+func newLRUStore(size int) *lruStore {
+	return &lruStore{size: size, ll: list.New(), m: make(map[string]*list.Element)}
+}
+
+func (s *lruStore) Seen(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.m[id]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(el.Value.(*lruEntry).expires) {
+		s.ll.Remove(el)
+		delete(s.m, id)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *lruStore) Mark(id string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires := time.Now().Add(ttl)
+	if el, ok := s.m[id]; ok {
+		el.Value.(*lruEntry).expires = expires
+		s.ll.MoveToFront(el)
+		return nil
+	}
+	s.m[id] = s.ll.PushFront(&lruEntry{id: id, expires: expires})
+	for s.ll.Len() > s.size {
+		el := s.ll.Back()
+		s.ll.Remove(el)
+		delete(s.m, el.Value.(*lruEntry).id)
+	}
+	return nil
+}
+
+// redisStore is idempotencyStore keeping ids in Redis, so that it can be
+// shared by several instances
+type redisStore struct {
+	c *redis.Client
+}
+
+// newRedisStore connects to Redis at url like "redis://host:6379/0"
+func newRedisStore(url string) (*redisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &redisStore{c: redis.NewClient(opts)}, nil
+}
+
+func (s *redisStore) Seen(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := s.c.Exists(ctx, redisKey(id)).Result()
+	return n > 0, err
+}
+
+func (s *redisStore) Mark(id string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.c.Set(ctx, redisKey(id), 1, ttl).Err()
+}
+
+func (s *redisStore) Check(ctx context.Context) error { return redisChecker{s.c}.Check(ctx) }
+
+func redisKey(id string) string { return "bouncehandler:sns:" + id }
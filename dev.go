@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// devReloader is http.Handler re-reading configuration before serving
+// requests, at most once per second, so that config edits take effect
+// without restart. It is meant for local development only: every request
+// may touch the filesystem and reconnect to databases.
+type devReloader struct {
+	next http.Handler
+	lc   *liveConfig
+	load func() (*config, error)
+
+	mu   sync.RWMutex // held for reading while request is served
+	last time.Time
+}
+
+func (d *devReloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.reload()
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	d.next.ServeHTTP(w, r)
+}
+
+// reload re-applies configuration if it was not done within the last
+// second, waiting for requests being served to finish first
+func (d *devReloader) reload() {
+	d.mu.RLock()
+	due := time.Since(d.last) >= time.Second
+	d.mu.RUnlock()
+	if !due {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Since(d.last) < time.Second { // reloaded by concurrent request
+		return
+	}
+	d.last = time.Now()
+	conf, err := d.load()
+	if err == nil {
+		err = d.lc.apply(conf)
+	}
+	if err != nil {
+		d.lc.log.Printf("dev config reload: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// bounceEvent is SES notification reduced to what blacklisters act upon
+type bounceEvent struct {
+	Sender     string
+	EventType  string // Bounce, Complaint or Delivery
+	Recipients []recipientEvent
+	Mail       mailInfo
+	Timestamp  time.Time // when event happened, or email was sent if unknown
+
+	// set for complaints only
+	ArrivalDate time.Time
+	UserAgent   string
+}
+
+// recipientEvent is a single recipient of bounceEvent
+type recipientEvent struct {
+	Email  string
+	Reason string // bounce diagnostic code or complaint feedback type
+}
+
+// errMessageNotJSON is returned for SNS messages whose Message field does
+// not hold SES notification json
+var errMessageNotJSON = errors.New("SNS Message field is not valid JSON; check SNS raw delivery setting")
+
+// parseSNSNotification parses decoded SNS notification with SES event, as
+// delivered to http endpoint or SQS queue. Messages of other SNS types are
+// reported as errors.
+func parseSNSNotification(sns *snsMsg, fields fieldMapping) (*bounceEvent, error) {
+	if sns.Type != "Notification" {
+		return nil, fmt.Errorf("unsupported SNS type %q", sns.Type)
+	}
+	return parseNotification(sns.Message, fields)
+}
+
+// parseRawSQSBody parses body of SQS message delivered from SNS topic with
+// raw message delivery enabled, which is SES notification json as is.
+// Fields are renamed according to fields mapping first, which may be nil.
+func parseRawSQSBody(body []byte, fields fieldMapping) (*payload, error) {
+	return decodePayload(string(body), fields)
+}
+
+// parseNotification parses SES notification json into bounceEvent. Fields
+// are renamed according to fields mapping first, which may be nil.
+func parseNotification(message string, fields fieldMapping) (*bounceEvent, error) {
+	msg, err := decodePayload(message, fields)
+	if err != nil {
+		return nil, err
+	}
+	return msg.event(), nil
+}
+
+// decodePayload decodes SES notification json, renaming its fields
+// according to fields mapping first
+func decodePayload(message string, fields fieldMapping) (*payload, error) {
+	if !json.Valid([]byte(message)) {
+		return nil, errMessageNotJSON
+	}
+	message, err := fields.canonical(message)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(payload)
+	if err := json.Unmarshal([]byte(message), msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// event returns bounceEvent of SES notification. Recipients of bounces are
+// only set for permanent ones.
+func (msg *payload) event() *bounceEvent {
+	ev := &bounceEvent{Sender: msg.Mail.Source, EventType: msg.Type, Mail: msg.Mail,
+		Timestamp: msg.Mail.Timestamp}
+	switch msg.Type {
+	case "Bounce":
+		if msg.Bounce != nil && !msg.Bounce.Timestamp.IsZero() {
+			ev.Timestamp = msg.Bounce.Timestamp
+		}
+		if msg.Bounce != nil && msg.Bounce.Type == "Permanent" {
+			for _, r := range msg.Bounce.Recipients {
+				ev.Recipients = append(ev.Recipients, recipientEvent{Email: r.Email, Reason: r.Diagnostic})
+			}
+		}
+	case "Complaint":
+		if c := msg.Complaint; c != nil {
+			ev.ArrivalDate, ev.UserAgent = c.ArrivalDate, c.UserAgent
+			if !c.Timestamp.IsZero() {
+				ev.Timestamp = c.Timestamp
+			}
+			for _, r := range c.Recipients {
+				feedback := r.Feedback
+				if feedback == "" {
+					feedback = c.Feedback
+				}
+				ev.Recipients = append(ev.Recipients, recipientEvent{Email: r.Email, Reason: feedback})
+			}
+		}
+	case "Delivery":
+		if msg.Delivery != nil {
+			if !msg.Delivery.Timestamp.IsZero() {
+				ev.Timestamp = msg.Delivery.Timestamp
+			}
+			for _, email := range msg.Delivery.Recipients {
+				ev.Recipients = append(ev.Recipients, recipientEvent{Email: email})
+			}
+		}
+	}
+	return ev
+}
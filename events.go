@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// bouncedEmail describes permanent bounce of email from Sender to Email
+type bouncedEmail struct {
+	Sender     string
+	Email      string
+	Diagnostic string    // diagnostic code reported by receiving server
+	Timestamp  time.Time // when bounce happened
+}
+
+// eventChans holds channels returned by BounceEvents and ComplaintEvents
+type eventChans struct {
+	bounces    chan bouncedEmail
+	complaints chan complaintEvent
+}
+
+// BounceEvents returns channel receiving every bounced recipient queued for
+// blacklisting, for callers preferring to consume structured events over
+// blacklister calls; senders still need to be registered. Channel is
+// buffered; if consumer does not keep up, events are dropped and reported to
+// overflow hook. Channel is closed when handler is closed.
+func (h *handler) BounceEvents() <-chan bouncedEmail {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.initEventChans()
+	return h.events.bounces
+}
+
+// ComplaintEvents is like BounceEvents, but for complained recipients
+func (h *handler) ComplaintEvents() <-chan complaintEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.initEventChans()
+	return h.events.complaints
+}
+
+// initEventChans creates event channels on first call, h.mu must be held
+func (h *handler) initEventChans() {
+	if h.events != nil {
+		return
+	}
+	h.events = &eventChans{
+		bounces:    make(chan bouncedEmail, 100),
+		complaints: make(chan complaintEvent, 100),
+	}
+	if h.ctx.Err() != nil {
+		close(h.events.bounces)
+		close(h.events.complaints)
+		return
+	}
+	go func() {
+		<-h.ctx.Done()
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		close(h.events.bounces)
+		close(h.events.complaints)
+	}()
+}
+
+// publishBounce sends ev to channel returned by BounceEvents without blocking
+func (h *handler) publishBounce(lg *log.Logger, ev bouncedEmail) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.events == nil || h.ctx.Err() != nil {
+		return
+	}
+	select {
+	case h.events.bounces <- ev:
+	default:
+		h.eventOverflow(lg, ev.Sender, ev.Email)
+	}
+}
+
+// publishComplaint sends ev to channel returned by ComplaintEvents without
+// blocking
+func (h *handler) publishComplaint(lg *log.Logger, ev complaintEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.events == nil || h.ctx.Err() != nil {
+		return
+	}
+	select {
+	case h.events.complaints <- ev:
+	default:
+		h.eventOverflow(lg, ev.Sender, ev.Email)
+	}
+}
+
+func (h *handler) eventOverflow(lg *log.Logger, sender, email string) {
+	lg.Printf("event channel overflow: from:%q to:%q", h.pii(sender), h.pii(email))
+	if h.onOverflow != nil {
+		h.onOverflow(sender, email)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// fieldMapping maps canonical SES notification field names, like
+// "notificationType", to names used by SES-like gateways emitting
+// notifications in the same shape, like "event_type"
+type fieldMapping map[string]string
+
+// readFieldMapping reads field mapping from json file holding object of
+// canonical to custom field names
+func readFieldMapping(name string) (fieldMapping, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var m fieldMapping
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	seen := make(map[string]string, len(m))
+	for canonical, custom := range m {
+		if other, ok := seen[custom]; ok {
+			return nil, fmt.Errorf("%s: both %q and %q are mapped to %q", name, other, canonical, custom)
+		}
+		seen[custom] = canonical
+	}
+	return m, nil
+}
+
+// withFieldMapping makes handler rename fields of notifications according
+// to m before parsing them
+func withFieldMapping(h *handler, m fieldMapping) *handler {
+	h.fields = m
+	return h
+}
+
+// canonical returns notification json with custom field names replaced by
+// canonical ones at any nesting level. Fields which already have canonical
+// names are kept as is.
+func (m fieldMapping) canonical(message string) (string, error) {
+	if len(m) == 0 {
+		return message, nil
+	}
+	rev := make(map[string]string, len(m))
+	for canonical, custom := range m {
+		rev[custom] = canonical
+	}
+	dec := json.NewDecoder(bytes.NewReader([]byte(message)))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(rename(v, rev))
+	return string(b), err
+}
+
+func rename(v any, rev map[string]string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, val := range v {
+			if canonical, ok := rev[k]; ok {
+				if _, exists := v[canonical]; !exists {
+					k = canonical
+				}
+			}
+			out[k] = rename(val, rev)
+		}
+		return out
+	case []any:
+		for i := range v {
+			v[i] = rename(v[i], rev)
+		}
+	}
+	return v
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// signatureHeader carries hex-encoded HMAC-SHA256 of forwarded request body
+const signatureHeader = "X-Bouncehandler-Signature"
+
+// forward re-posts raw SNS message body to the fallback url in background.
+// Request carries "X-Bouncehandler-Signature: sha256=<hex>" header with HMAC
+// of body keyed by fallback secret. Does nothing if fallback is not
+// configured.
+func (h *handler) forward(lg *log.Logger, body []byte) {
+	if h.fallbackURL == "" {
+		return
+	}
+	sig := "sha256=" + bodyMAC(h.fallbackSecret, body)
+	go func() {
+		if err := postSigned(h.fallbackURL, sig, body); err != nil {
+			lg.Printf("fallback forward: %v", err)
+		}
+	}()
+}
+
+// bodyMAC returns hex-encoded HMAC-SHA256 of body keyed by secret
+func bodyMAC(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func postSigned(url, sig string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureHeader, sig)
+	resp, err := forwardClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+var forwardClient = &http.Client{Timeout: 30 * time.Second}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const healthPath = "/health"
+
+// checker verifies that backend is usable
+type checker interface {
+	Check(ctx context.Context) error
+}
+
+// dbChecker checks SQL database by pinging it. It also closes database, so
+// that it can be returned as blacklister resources.
+type dbChecker struct{ *sql.DB }
+
+func (c dbChecker) Check(ctx context.Context) error { return c.PingContext(ctx) }
+
+// redisChecker checks Redis server by pinging it
+type redisChecker struct{ *redis.Client }
+
+func (c redisChecker) Check(ctx context.Context) error { return c.Ping(ctx).Err() }
+
+// checkCloser combines closer and check functions of blacklister resources
+type checkCloser struct {
+	close func() error
+	check func(ctx context.Context) error
+}
+
+func (c checkCloser) Close() error                    { return c.close() }
+func (c checkCloser) Check(ctx context.Context) error { return c.check(ctx) }
+
+// AddChecker makes health endpoint report results of c under given name, in
+// addition to checks of registered blacklisters
+func (h *handler) AddChecker(name string, c checker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checkers == nil {
+		h.checkers = make(map[string]checker)
+	}
+	h.checkers[name] = c
+}
+
+// checks returns custom checkers and checkers of registered blacklisters,
+// keyed by their names
+func (h *handler) checks() map[string]checker {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make(map[string]checker, len(h.checkers)+len(h.m))
+	for k, c := range h.checkers {
+		out[k] = c
+	}
+	for k, s := range h.m {
+		c, ok := s.closer.(checker)
+		if !ok {
+			continue
+		}
+		name := k.sender
+		if k.policy != anyType {
+			name += "#" + string(k.policy)
+		}
+		out[name] = c
+	}
+	return out
+}
+
+// healthCacheTTL is how long results of checks are reused, so that frequent
+// health requests do not ping every backend each time
+const healthCacheTTL = 5 * time.Second
+
+// healthCache holds results of the latest checks run
+type healthCache struct {
+	mu      sync.Mutex // held while checks run
+	at      time.Time
+	results map[string]string
+	status  int
+}
+
+// serveHealth responds with json object mapping check names to "ok" or
+// "fail", with 503 status if any check failed. If detailed is false, only
+// overall status is reported, without check names. Error details are only
+// logged.
+func (h *handler) serveHealth(w http.ResponseWriter, r *http.Request, detailed bool) {
+	results, status := h.healthResults()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if !detailed {
+		res := "ok"
+		if status != http.StatusOK {
+			res = "fail"
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": res})
+		return
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// healthResults runs all checks concurrently, unless they were run within
+// healthCacheTTL, and returns their results with response status
+func (h *handler) healthResults() (map[string]string, int) {
+	h.health.mu.Lock()
+	defer h.health.mu.Unlock()
+	if time.Since(h.health.at) < healthCacheTTL {
+		return h.health.results, h.health.status
+	}
+	ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
+	defer cancel()
+	checks := h.checks()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]string, len(checks))
+	status := http.StatusOK
+	for name, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := "ok"
+			if err := c.Check(ctx); err != nil {
+				h.log.Printf("health check %q: %v", name, err)
+				res = "fail"
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results[name] = res
+			if res != "ok" {
+				status = http.StatusServiceUnavailable
+			}
+		}()
+	}
+	wg.Wait()
+	h.health.at, h.health.results, h.health.status = time.Now(), results, status
+	return results, status
+}
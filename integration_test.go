@@ -0,0 +1,183 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// TestIntegration runs SNS to bouncehandler flow against localstack at
+// LOCALSTACK_ENDPOINT: bounce notification published to SNS topic should
+// reach blacklisters of handler subscribed over http and of one consuming
+// SQS queue subscribed to the same topic. If localstack runs in a container,
+// set LOCALSTACK_CALLBACK_HOST to the host name it reaches this machine at,
+// like host.docker.internal.
+//
+//	LOCALSTACK_ENDPOINT=http://localhost:4566 go test -tags integration -run TestIntegration
+func TestIntegration(t *testing.T) {
+	endpoint := os.Getenv("LOCALSTACK_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("LOCALSTACK_ENDPOINT is not set")
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(endpoint),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("test", "test", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	snsClient, sqsClient := sns.New(sess), sqs.New(sess)
+
+	topic, err := snsClient.CreateTopicWithContext(ctx, &sns.CreateTopicInput{Name: aws.String("bouncehandler-integration")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { snsClient.DeleteTopic(&sns.DeleteTopicInput{TopicArn: topic.TopicArn}) })
+
+	const from, to = "news@example.com", "user@example.net"
+	httpEmails, sqsEmails := make(chan string, 1), make(chan string, 1)
+
+	// http subscriber; localstack subscription urls are not AWS ones, which
+	// handler does not follow, so subscription is confirmed with API call
+	h := newHandler()
+	defer h.Close()
+	h.Register(from, func(email string) error { httpEmails <- email; return nil })
+	confirm := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var msg struct{ Type, Token string }
+		if json.Unmarshal(body, &msg) == nil && msg.Type == "SubscriptionConfirmation" {
+			if _, err := snsClient.ConfirmSubscription(&sns.ConfirmSubscriptionInput{
+				TopicArn: topic.TopicArn,
+				Token:    aws.String(msg.Token),
+			}); err != nil {
+				t.Errorf("confirming subscription: %v", err)
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(w, r)
+	})
+	srv := httptest.NewUnstartedServer(confirm)
+	subURL := "http://" + srv.Listener.Addr().String() + "/"
+	if host := os.Getenv("LOCALSTACK_CALLBACK_HOST"); host != "" {
+		srv.Listener.Close()
+		if srv.Listener, err = net.Listen("tcp", ":0"); err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		subURL = (&url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: "/"}).String()
+	}
+	srv.Start()
+	defer srv.Close()
+	if _, err := snsClient.SubscribeWithContext(ctx, &sns.SubscribeInput{
+		TopicArn: topic.TopicArn,
+		Protocol: aws.String("http"),
+		Endpoint: aws.String(subURL),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// SQS subscriber
+	queue, err := sqsClient.CreateQueueWithContext(ctx, &sqs.CreateQueueInput{QueueName: aws.String("bouncehandler-integration")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqsClient.DeleteQueue(&sqs.DeleteQueueInput{QueueUrl: queue.QueueUrl}) })
+	attrs, err := sqsClient.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       queue.QueueUrl,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snsClient.SubscribeWithContext(ctx, &sns.SubscribeInput{
+		TopicArn: topic.TopicArn,
+		Protocol: aws.String("sqs"),
+		Endpoint: attrs.Attributes[sqs.QueueAttributeNameQueueArn],
+	}); err != nil {
+		t.Fatal(err)
+	}
+	qh := newHandler()
+	defer qh.Close()
+	qh.Register(from, func(email string) error { sqsEmails <- email; return nil })
+	consumerCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go newSQSConsumer(*queue.QueueUrl, false, sqsClient, qh).Run(consumerCtx)
+
+	waitConfirmed(ctx, t, snsClient, *topic.TopicArn)
+	msg, err := json.Marshal(map[string]any{
+		"notificationType": "Bounce",
+		"mail": map[string]any{
+			"timestamp":   time.Now().UTC().Format(time.RFC3339),
+			"messageId":   "integration-test",
+			"source":      from,
+			"destination": []string{to},
+		},
+		"bounce": map[string]any{
+			"bounceType":        "Permanent",
+			"bouncedRecipients": []map[string]string{{"emailAddress": to}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snsClient.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: topic.TopicArn,
+		Message:  aws.String(string(msg)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for name, ch := range map[string]chan string{"http": httpEmails, "sqs": sqsEmails} {
+		select {
+		case got := <-ch:
+			if got != to {
+				t.Errorf("%s subscriber blacklisted %q, want %q", name, got, to)
+			}
+		case <-time.After(20 * time.Second):
+			t.Errorf("%s subscriber did not blacklist %q", name, to)
+		}
+	}
+}
+
+// waitConfirmed waits for all subscriptions of topic to be confirmed
+func waitConfirmed(ctx context.Context, t *testing.T, client *sns.SNS, topicARN string) {
+	t.Helper()
+	for {
+		out, err := client.ListSubscriptionsByTopicWithContext(ctx, &sns.ListSubscriptionsByTopicInput{TopicArn: aws.String(topicARN)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending := false
+		for _, s := range out.Subscriptions {
+			if aws.StringValue(s.SubscriptionArn) == "PendingConfirmation" {
+				pending = true
+			}
+		}
+		if !pending {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("subscriptions were not confirmed")
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
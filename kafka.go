@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaConsumer reads SNS-wrapped SES notifications from Kafka topic and
+// passes them to handler. Instances sharing the same consumer group split
+// topic partitions between them.
+type kafkaConsumer struct {
+	r *kafka.Reader
+	h *handler
+}
+
+func newKafkaConsumer(brokers []string, topic, group string, h *handler) *kafkaConsumer {
+	return &kafkaConsumer{
+		r: kafka.NewReader(kafka.ReaderConfig{
+			Brokers: brokers,
+			Topic:   topic,
+			GroupID: group,
+		}),
+		h: h,
+	}
+}
+
+// Run consumes messages until ctx is canceled or reader fails. Offsets are
+// committed after message is queued for processing; malformed messages are
+// logged and skipped. Messages failing with errBackPressure are retried with
+// growing delay without committing their offsets, so they are not lost.
+func (c *kafkaConsumer) Run(ctx context.Context) error {
+	for {
+		m, err := c.r.FetchMessage(ctx)
+		if err != nil {
+			return err
+		}
+		for delay := time.Second; ; delay = min(2*delay, time.Minute) {
+			err := c.h.consume(m.Value)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, errBackPressure) {
+				c.h.log.Printf("kafka message at offset %d: %v", m.Offset, err)
+				break
+			}
+			c.h.log.Printf("kafka message at offset %d: %v, retrying in %v", m.Offset, err, delay)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+		if err := c.r.CommitMessages(ctx, m); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes underlying Kafka reader
+func (c *kafkaConsumer) Close() error { return c.r.Close() }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+)
+
+// setTimestampFormat changes format of l timestamps: "default" keeps
+// log.LstdFlags one, "rfc3339" writes RFC 3339 timestamps with nanoseconds
+// in UTC, "unix" writes seconds since Unix epoch
+func setTimestampFormat(l *log.Logger, format string) error {
+	var stamp func([]byte, time.Time) []byte
+	switch format {
+	case "default":
+		return nil
+	case "rfc3339":
+		stamp = func(b []byte, t time.Time) []byte { return t.UTC().AppendFormat(b, time.RFC3339Nano) }
+	case "unix":
+		stamp = func(b []byte, t time.Time) []byte { return strconv.AppendInt(b, t.Unix(), 10) }
+	default:
+		return fmt.Errorf("invalid -log-timestamp-format value: %q", format)
+	}
+	l.SetFlags(l.Flags() &^ (log.Ldate | log.Ltime | log.Lmicroseconds | log.LUTC))
+	l.SetOutput(timestampWriter{w: l.Writer(), stamp: stamp})
+	return nil
+}
+
+// timestampWriter prepends timestamp to every log entry written to w
+type timestampWriter struct {
+	w     io.Writer
+	stamp func([]byte, time.Time) []byte
+}
+
+func (t timestampWriter) Write(p []byte) (int, error) {
+	b := append(t.stamp(make([]byte, 0, 32+len(p)), time.Now()), ' ')
+	if _, err := t.w.Write(append(b, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
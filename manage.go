@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// serveManagement serves management API at addr, requests should carry
+// token as bearer token
+func serveManagement(addr, token string, lc *liveConfig, logger *log.Logger) error {
+	srv := &http.Server{Addr: addr, Handler: newManageHandler(lc, token), ErrorLog: logger}
+	return srv.ListenAndServe()
+}
+
+// newManageHandler returns handler of management API changing configuration
+// tracked by lc. Changes are not persisted and are lost once configuration
+// is reloaded from its source.
+func newManageHandler(lc *liveConfig, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config", lc.getConfig)
+	mux.HandleFunc("PATCH /senders/{name}", lc.patchSender)
+	mux.HandleFunc("POST /stats/reset", lc.resetStats)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// getConfig responds with json of active sender records, with credentials
+// of their database DSNs and URIs redacted
+func (lc *liveConfig) getConfig(w http.ResponseWriter, r *http.Request) {
+	lc.mu.Lock()
+	out := make(map[string]cred, len(lc.senders))
+	for name, c := range lc.senders {
+		c.DSN, c.URI = redactDSN(c.DSN), redactDSN(c.URI)
+		out[name] = c
+	}
+	lc.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
+
+// redactDSN replaces credentials of dsn, the part before the last "@" and
+// after url scheme if any, with "***"
+func redactDSN(dsn string) string {
+	i := strings.LastIndex(dsn, "@")
+	if i < 0 {
+		return dsn
+	}
+	if j := strings.Index(dsn, "://"); j >= 0 && j < i {
+		return dsn[:j+3] + "***" + dsn[i:]
+	}
+	return "***" + dsn[i:]
+}
+
+// patchSender updates dsn and/or sql of sender record, replacing its
+// blacklisters. If new record is invalid or its database is unreachable,
+// previous version is kept.
+func (lc *liveConfig) patchSender(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DSN   *string `json:"dsn"`
+		Query *string `json:"sql"`
+	}
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.DSN == nil && req.Query == nil {
+		http.Error(w, "either dsn or sql should be set", http.StatusBadRequest)
+		return
+	}
+	name := r.PathValue("name")
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	c, ok := lc.senders[name]
+	if !ok {
+		http.Error(w, "sender not found", http.StatusNotFound)
+		return
+	}
+	if req.DSN != nil {
+		c.DSN = *req.DSN
+	}
+	if req.Query != nil {
+		c.Query = *req.Query
+	}
+	if err := validateConfig(map[string]cred{name: c}); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	prev := lc.senders
+	next := maps.Clone(prev)
+	next[name] = c
+	if err := lc.applySenders(next); err != nil {
+		lc.senders = prev // applySenders kept previous blacklisters
+		lc.log.Printf("management api: updating %q: %v", name, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	lc.log.Printf("management api: updated %q", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resetStats resets email counters of all senders, including tenant ones
+func (lc *liveConfig) resetStats(w http.ResponseWriter, r *http.Request) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.h.ResetCounters()
+	for _, t := range lc.tenants {
+		t.h.ResetCounters()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
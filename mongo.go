@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// mongoBlacklister returns blacklister upserting {field: email,
+// suppressed_at: time} documents into MongoDB collection. If field is empty,
+// "email" is used.
+func mongoBlacklister(uri, database, collection, field string) (blacklister, io.Closer, error) {
+	if field == "" {
+		field = "email"
+	}
+	client, err := openMongo(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	coll := client.Database(database).Collection(collection)
+	opts := options.Update().SetUpsert(true)
+	return func(email string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, err := coll.UpdateOne(ctx, bson.M{field: email},
+			bson.M{"$set": bson.M{"suppressed_at": time.Now()}}, opts)
+		return err
+	}, checkCloser{
+		close: func() error { return client.Disconnect(context.Background()) },
+		check: func(ctx context.Context) error { return client.Ping(ctx, readpref.Primary()) },
+	}, nil
+}
+
+// openMongo connects to MongoDB and verifies connection is usable
+func openMongo(uri string) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
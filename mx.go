@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mxValidator checks that email domains have MX records, remembering
+// domains without them for timeout
+type mxValidator struct {
+	timeout  time.Duration
+	lookupMX func(ctx context.Context, name string) ([]*net.MX, error)
+
+	mu  sync.Mutex
+	bad map[string]time.Time // domain to time its negative result expires
+}
+
+// withMXValidation makes handler skip emails whose domain has no MX records
+// or could not be resolved within timeout. Negative results are cached per
+// domain for timeout too.
+func withMXValidation(h *handler, timeout time.Duration) *handler {
+	h.mx = &mxValidator{
+		timeout:  timeout,
+		lookupMX: net.DefaultResolver.LookupMX,
+		bad:      make(map[string]time.Time),
+	}
+	return h
+}
+
+// withCustomResolver makes MX validation enabled with withMXValidation use
+// resolver r instead of the system one. Resolver querying specific DNS
+// server can be made with dnsServerResolver.
+func withCustomResolver(h *handler, r *net.Resolver) *handler {
+	h.mx.lookupMX = r.LookupMX
+	return h
+}
+
+// dnsServerResolver returns resolver sending all queries to DNS server at
+// addr, given as host:port
+func dnsServerResolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// check returns non-nil error if email domain has no usable MX records
+func (v *mxValidator) check(email string) error {
+	i := strings.LastIndexByte(email, '@')
+	if i < 0 || i == len(email)-1 {
+		return fmt.Errorf("no domain")
+	}
+	domain := strings.ToLower(email[i+1:])
+	v.mu.Lock()
+	exp, ok := v.bad[domain]
+	if ok && time.Now().After(exp) {
+		delete(v.bad, domain)
+		ok = false
+	}
+	v.mu.Unlock()
+	if ok {
+		return fmt.Errorf("domain %q has no MX records (cached)", domain)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+	mxs, err := v.lookupMX(ctx, domain)
+	if err == nil && len(mxs) == 0 {
+		err = fmt.Errorf("domain %q has no MX records", domain)
+	}
+	if err != nil {
+		v.mu.Lock()
+		v.bad[domain] = time.Now().Add(v.timeout)
+		v.mu.Unlock()
+	}
+	return err
+}
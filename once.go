@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// runOnce processes single SNS notification read from r, calling
+// blacklisters of lc.h synchronously. It returns error if notification
+// cannot be processed or any blacklister call failed. Tenants of conf are
+// ignored.
+func runOnce(lc *liveConfig, conf *config, r io.Reader) error {
+	lc.h.sync = true
+	if err := lc.apply(&config{senders: conf.senders}); err != nil {
+		return err
+	}
+	defer lc.apply(&config{})
+	body, err := io.ReadAll(io.LimitReader(r, 2<<20))
+	if err != nil {
+		return err
+	}
+	return processOnce(lc.h, body)
+}
+
+// runReplay works like runOnce, but processes every .json file in dir, in
+// lexical order of their names. Errors do not stop processing of other
+// files, they are reported together once all files are processed.
+func runReplay(lc *liveConfig, conf *config, dir string) error {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no .json files in %s", dir)
+	}
+	lc.h.sync = true
+	if err := lc.apply(&config{senders: conf.senders}); err != nil {
+		return err
+	}
+	defer lc.apply(&config{})
+	var errs []error
+	for _, name := range names { // Glob returns sorted names
+		body, err := os.ReadFile(name)
+		if err == nil {
+			err = processOnce(lc.h, body)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	lc.h.log.Printf("replayed %d files, %d failed", len(names), len(errs))
+	return errors.Join(errs...)
+}
+
+// processOnce processes SNS notification body with h in synchronous mode
+func processOnce(h *handler, body []byte) error {
+	h.syncErrs = nil
+	sns := new(snsMsg)
+	if err := json.Unmarshal(body, sns); err != nil {
+		return err
+	}
+	ev, err := parseSNSNotification(sns, h.fields)
+	if err != nil {
+		return err
+	}
+	if err := h.dispatch(h.log, ev); err != nil {
+		return err
+	}
+	return errors.Join(h.syncErrs...)
+}
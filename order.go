@@ -0,0 +1,91 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// timestampOrderer holds notifications for a window after their arrival and
+// releases them in order of event timestamps, per sender
+type timestampOrderer struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	senders map[string]*heldEvents
+}
+
+type heldEvent struct {
+	ev      *bounceEvent
+	arrived time.Time
+}
+
+// heldEvents is heap of events ordered by their timestamps
+type heldEvents []heldEvent
+
+func (h heldEvents) Len() int           { return len(h) }
+func (h heldEvents) Less(i, j int) bool { return h[i].ev.Timestamp.Before(h[j].ev.Timestamp) }
+func (h heldEvents) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *heldEvents) Push(x any)        { *h = append(*h, x.(heldEvent)) }
+func (h *heldEvents) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// withTimestampOrdering makes handler hold notifications for window after
+// they arrive and dispatch them per sender in order of event timestamps, so
+// that notifications delivered out of order within window are processed in
+// the order they happened. Notifications of unconfigured senders are not
+// held, so that they can still be forwarded.
+func withTimestampOrdering(h *handler, window time.Duration) *handler {
+	o := &timestampOrderer{window: window, senders: make(map[string]*heldEvents)}
+	h.order = o
+	go func() {
+		ticker := time.NewTicker(max(window/10, 10*time.Millisecond))
+		defer ticker.Stop()
+		for done := false; !done; {
+			var now time.Time
+			select {
+			case <-h.ctx.Done():
+				done = true // release everything still held
+			case now = <-ticker.C:
+			}
+			for _, ev := range o.release(now) {
+				if err := h.dispatchNow(h.log, ev); err != nil {
+					h.log.Printf("ordered %s from %q: %v", ev.EventType, h.pii(ev.Sender), err)
+				}
+			}
+		}
+	}()
+	return h
+}
+
+func (o *timestampOrderer) hold(ev *bounceEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	q, ok := o.senders[ev.Sender]
+	if !ok {
+		q = new(heldEvents)
+		o.senders[ev.Sender] = q
+	}
+	heap.Push(q, heldEvent{ev: ev, arrived: time.Now()})
+}
+
+// release removes events that are due at now and returns them in dispatch
+// order. Zero now releases all events.
+func (o *timestampOrderer) release(now time.Time) []*bounceEvent {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var out []*bounceEvent
+	for sender, q := range o.senders {
+		for q.Len() > 0 && (now.IsZero() || now.Sub((*q)[0].arrived) >= o.window) {
+			out = append(out, heap.Pop(q).(heldEvent).ev)
+		}
+		if q.Len() == 0 {
+			delete(o.senders, sender)
+		}
+	}
+	return out
+}
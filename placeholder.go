@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// placeholderStyle is syntax of query parameter placeholders
+type placeholderStyle int
+
+const (
+	questionMark placeholderStyle = iota // ?, MySQL
+	dollar                               // $1, $2, ..., PostgreSQL
+	colon                                // :1, :2, ..., Oracle
+)
+
+// placeholderStyleOf returns placeholder style of queries written for SQL
+// driver of config record: "mysql" (default), "postgres" or "oracle"
+func placeholderStyleOf(driver string) (placeholderStyle, error) {
+	switch driver {
+	case "", "mysql":
+		return questionMark, nil
+	case "postgres":
+		return dollar, nil
+	case "oracle":
+		return colon, nil
+	}
+	return 0, fmt.Errorf("unsupported driver %q", driver)
+}
+
+var numberedPlaceholders = map[placeholderStyle]*regexp.Regexp{
+	dollar: regexp.MustCompile(`\$(\d+)`),
+	colon:  regexp.MustCompile(`:(\d+)`),
+}
+
+// normalize rewrites query to use ? placeholders that MySQL connection
+// takes, returning number of parameters query takes and, for numbered
+// placeholders, 0-based number of argument taken by every ? of rewritten
+// query. Numbered placeholders must be numbered from 1 without gaps; the
+// same number may be used several times.
+//
+// Placeholders are found by plain text search, so "?", "$1" or ":1" inside
+// string literals and comments are counted as placeholders too.
+func (p placeholderStyle) normalize(query string) (string, int, []int, error) {
+	if p == questionMark {
+		return query, strings.Count(query, "?"), nil, nil
+	}
+	var order []int
+	seen := make(map[int]bool)
+	var err error
+	q := numberedPlaceholders[p].ReplaceAllStringFunc(query, func(m string) string {
+		n, e := strconv.Atoi(m[1:])
+		if e != nil || n < 1 {
+			err = fmt.Errorf("invalid placeholder %q", m)
+			return m
+		}
+		seen[n] = true
+		order = append(order, n-1)
+		return "?"
+	})
+	if err != nil {
+		return "", 0, nil, err
+	}
+	for i := 1; i <= len(seen); i++ {
+		if !seen[i] {
+			return "", 0, nil, fmt.Errorf("placeholders are not numbered from 1 without gaps")
+		}
+	}
+	return q, len(seen), order, nil
+}
+
+// checkPlaceholders returns error if query with placeholders of given style
+// does not take exactly want parameters
+func checkPlaceholders(style placeholderStyle, query string, want int) error {
+	_, n, _, err := style.normalize(query)
+	if err != nil {
+		return err
+	}
+	if n != want {
+		if want == 1 {
+			return fmt.Errorf("expected exactly 1 placeholder")
+		}
+		return fmt.Errorf("expected exactly %d placeholders", want)
+	}
+	return nil
+}
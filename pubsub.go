@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// pubSubConsumer receives SES notifications from GCP Pub/Sub subscription
+// and passes them to handler. Messages may either be SNS-wrapped, as
+// delivered to http endpoint, or raw SES notification json.
+type pubSubConsumer struct {
+	c   *pubsub.Client
+	sub *pubsub.Subscription
+	h   *handler
+}
+
+func newPubSubConsumer(ctx context.Context, project, subscription string, h *handler) (*pubSubConsumer, error) {
+	c, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	return &pubSubConsumer{c: c, sub: c.Subscription(subscription), h: h}, nil
+}
+
+// Run receives messages until ctx is canceled or subscription fails. Messages
+// are acknowledged once queued for processing; malformed ones are logged
+// and nacked, so they end up in subscription's dead letter topic if one is
+// configured.
+func (c *pubSubConsumer) Run(ctx context.Context) error {
+	return c.sub.Receive(ctx, func(_ context.Context, m *pubsub.Message) {
+		if err := c.h.consume(m.Data); err != nil {
+			c.h.log.Printf("pubsub message %s: %v", m.ID, err)
+			m.Nack()
+			return
+		}
+		m.Ack()
+	})
+}
+
+// Close closes underlying Pub/Sub client
+func (c *pubSubConsumer) Close() error { return c.c.Close() }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// diskQueue is a file-backed FIFO of emails. Records are stored as 4-byte
+// big-endian length followed by email bytes and are appended to the data
+// file, which is synced on every push. Offset of the first unprocessed record
+// is kept in a separate file, so that records pushed but not yet acknowledged
+// are replayed after restart.
+type diskQueue struct {
+	mu   sync.Mutex
+	data *os.File
+	off  *os.File
+	size int64 // end of data
+	rpos int64 // next record to hand out
+	cpos int64 // first record not yet acknowledged
+
+	notify chan struct{}
+}
+
+// openDiskQueue opens queue for given sender in dir, creating it if needed.
+// Incomplete record at the end of data file, left if process crashed during
+// write, is discarded.
+func openDiskQueue(dir, sender string) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, url.QueryEscape(sender))
+	data, err := os.OpenFile(name+".queue", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	off, err := os.OpenFile(name+".offset", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	q := &diskQueue{data: data, off: off, notify: make(chan struct{}, 1)}
+	var b [8]byte
+	switch _, err := off.ReadAt(b[:], 0); err {
+	case nil:
+		q.cpos = int64(binary.BigEndian.Uint64(b[:]))
+	case io.EOF:
+	default:
+		q.Close()
+		return nil, err
+	}
+	if err := q.recover(); err != nil {
+		q.Close()
+		return nil, err
+	}
+	q.rpos = q.cpos
+	return q, nil
+}
+
+// recover finds end of the last complete record and truncates data file there
+func (q *diskQueue) recover() error {
+	fi, err := q.data.Stat()
+	if err != nil {
+		return err
+	}
+	if q.cpos > fi.Size() {
+		q.cpos = fi.Size()
+	}
+	pos := q.cpos
+	for {
+		n, err := q.recordLen(pos)
+		if err != nil || pos+4+n > fi.Size() {
+			break
+		}
+		pos += 4 + n
+	}
+	if pos < fi.Size() {
+		if err := q.data.Truncate(pos); err != nil {
+			return err
+		}
+	}
+	q.size = pos
+	return nil
+}
+
+func (q *diskQueue) recordLen(pos int64) (int64, error) {
+	var b [4]byte
+	if _, err := q.data.ReadAt(b[:], pos); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint32(b[:])), nil
+}
+
+// push durably appends email to the queue
+func (q *diskQueue) push(email string) error {
+	buf := make([]byte, 4+len(email))
+	binary.BigEndian.PutUint32(buf, uint32(len(email)))
+	copy(buf[4:], email)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, err := q.data.Write(buf); err != nil {
+		q.data.Truncate(q.size)
+		return err
+	}
+	if err := q.data.Sync(); err != nil {
+		return err
+	}
+	q.size += int64(len(buf))
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next returns the next record not yet handed out, blocking until one is
+// available or ctx is canceled
+func (q *diskQueue) next(ctx context.Context) (string, error) {
+	for {
+		q.mu.Lock()
+		if q.rpos < q.size {
+			email, err := q.read(q.rpos)
+			if err == nil {
+				q.rpos += 4 + int64(len(email))
+			}
+			q.mu.Unlock()
+			return email, err
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.notify:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func (q *diskQueue) read(pos int64) (string, error) {
+	n, err := q.recordLen(pos)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := q.data.ReadAt(buf, pos+4); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// feed sends queued records to ch until ctx is canceled or stop is closed
+func (q *diskQueue) feed(ctx context.Context, stop <-chan struct{}, ch chan<- string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		email, err := q.next(ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case ch <- email:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// rewind makes records handed out but not acknowledged available again
+func (q *diskQueue) rewind() {
+	q.mu.Lock()
+	q.rpos = q.cpos
+	q.mu.Unlock()
+}
+
+// ack marks the oldest handed out record as processed. Once all records are
+// processed, data file is truncated.
+func (q *diskQueue) ack(email string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n := 4 + int64(len(email)); q.cpos+n <= q.rpos {
+		q.cpos += n
+	} else {
+		return errors.New("acknowledged record that was not read")
+	}
+	if q.cpos == q.size {
+		if err := q.data.Truncate(0); err != nil {
+			return err
+		}
+		q.size, q.rpos, q.cpos = 0, 0, 0
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(q.cpos))
+	if _, err := q.off.WriteAt(b[:], 0); err != nil {
+		return err
+	}
+	return q.off.Sync()
+}
+
+// Close closes underlying files
+func (q *diskQueue) Close() error {
+	err := q.data.Close()
+	if err2 := q.off.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+	"github.com/go-sql-driver/mysql"
+)
+
+// iamTokenRefresh is how often RDS IAM auth tokens are regenerated, tokens
+// are valid for 15 minutes
+const iamTokenRefresh = 10 * time.Minute
+
+// iamBlacklister works like sqlBlacklister, but authenticates to RDS with IAM
+// auth token instead of password from DSN. Token is regenerated in
+// background, new connections use the latest one.
+func iamBlacklister(dsn, query string, p poolConfig, logger *log.Logger, args queryArgs) (blacklister, io.Closer, error) {
+	dsn, err := p.dsn(dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := newIAMConnector(dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	db := sql.OpenDB(c)
+	p.apply(db)
+	// connections outliving token are fine, but keep them recycled at
+	// token pace so that revoked access is noticed
+	if d := time.Duration(p.ConnMaxLifetime); d < 0 || d > iamTokenRefresh {
+		db.SetConnMaxLifetime(iamTokenRefresh)
+	}
+	if err := pingDB(db, dsn); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(iamTokenRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := c.refresh(); err != nil {
+				logger.Printf("RDS IAM token for %s: %v", dsnName(dsn), err)
+			}
+		}
+	}()
+	return func(email string) error {
+		_, err := db.Exec(query, args.of(email)...)
+		return err
+	}, checkCloser{
+		close: func() error { close(done); return db.Close() },
+		check: db.PingContext,
+	}, nil
+}
+
+// iamConnector opens MySQL connections authenticated with the current IAM
+// auth token
+type iamConnector struct {
+	cfg    *mysql.Config // without password
+	region string
+
+	mu    sync.Mutex
+	token string
+}
+
+func newIAMConnector(dsn string) (*iamConnector, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := newAWSSession()
+	if err != nil {
+		return nil, err
+	}
+	cfg.AllowCleartextPasswords = true // IAM tokens are sent as cleartext passwords
+	if cfg.TLSConfig == "" {
+		cfg.TLSConfig = "true"
+	}
+	c := &iamConnector{cfg: cfg, region: aws.StringValue(sess.Config.Region)}
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// refresh generates new auth token
+func (c *iamConnector) refresh() error {
+	sess, err := newAWSSession()
+	if err != nil {
+		return err
+	}
+	token, err := rdsutils.BuildAuthToken(c.cfg.Addr, c.region, c.cfg.User, sess.Config.Credentials)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+	return nil
+}
+
+func (c *iamConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	cfg := c.cfg.Clone()
+	cfg.Passwd = c.token
+	c.mu.Unlock()
+	conn, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Connect(ctx)
+}
+
+func (c *iamConnector) Driver() driver.Driver { return &mysql.MySQLDriver{} }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// liveConfig tracks configuration applied to handler, so that updated
+// configuration can be applied by only replacing changed records
+type liveConfig struct {
+	h       *handler
+	refresh time.Duration // dsn_secret refresh interval
+	log     *log.Logger
+	dryRun  bool // whether noop records are allowed
+
+	// newTenant creates handler for the named tenant
+	newTenant func(name string) *handler
+
+	mu      sync.Mutex
+	applied map[queueKey]cred
+	senders map[string]cred // records of the last applied config
+	tenants map[string]*liveConfig
+}
+
+// registrations maps config records to handler registrations: records with
+// complaint_sql or pass_bounce_type result in separate bounce and complaint
+// blacklisters. Keys are
+// also returned in config order, so that sender patterns are registered in
+// the order they should be evaluated.
+func registrations(creds map[string]cred) (map[queueKey]cred, []queueKey) {
+	out := make(map[queueKey]cred, len(creds))
+	for k, v := range creds {
+		v.order = 0 // only affects registration order
+		if v.ComplaintQuery == "" && !v.PassBounceType {
+			out[queueKey{k, anyType}] = v
+			continue
+		}
+		c := v
+		if v.ComplaintQuery != "" {
+			c.Query, c.Mode = v.ComplaintQuery, modeExec
+		}
+		v.policy, c.policy = bounceOnly, complaintOnly
+		out[queueKey{k, bounceOnly}] = v
+		out[queueKey{k, complaintOnly}] = c
+	}
+	keys := make([]queueKey, 0, len(out))
+	for k := range out {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if oa, ob := creds[a.sender].order, creds[b.sender].order; oa != ob {
+			return oa < ob
+		}
+		if a.sender != b.sender {
+			return a.sender < b.sender
+		}
+		return a.policy < b.policy
+	})
+	return out, keys
+}
+
+// apply makes handler use blacklisters defined by conf: new and modified
+// records are registered, removed ones are unregistered. If blacklister for
+// some record cannot be created, previous version of this record is kept
+// and error is reported once all other records are applied. Tenants are
+// created and removed the same way.
+func (lc *liveConfig) apply(conf *config) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	errs := []error{lc.applySenders(conf.senders)}
+	if lc.tenants == nil {
+		lc.tenants = make(map[string]*liveConfig)
+	}
+	for name, tc := range conf.tenants {
+		t, ok := lc.tenants[name]
+		if !ok {
+			t = &liveConfig{h: lc.newTenant(name), refresh: lc.refresh, log: lc.log, dryRun: lc.dryRun}
+			lc.tenants[name] = t
+		}
+		if err := t.applySenders(tc.Senders); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %q: %w", name, err))
+		}
+		lc.h.setTenant(name, t.h, tc.User, tc.Pass)
+	}
+	for name, t := range lc.tenants {
+		if _, ok := conf.tenants[name]; ok {
+			continue
+		}
+		lc.h.removeTenant(name)
+		if err := t.applySenders(nil); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %q: %w", name, err))
+		}
+		t.h.Close()
+		delete(lc.tenants, name)
+	}
+	return errors.Join(errs...)
+}
+
+// applySenders registers and unregisters blacklisters of lc.h to match creds
+func (lc *liveConfig) applySenders(creds map[string]cred) error {
+	if lc.applied == nil {
+		lc.applied = make(map[queueKey]cred)
+	}
+	lc.senders = creds
+	next, keys := registrations(creds)
+	var errs []error
+	for _, key := range keys {
+		c := next[key]
+		if old, ok := lc.applied[key]; ok && reflect.DeepEqual(old, c) {
+			continue
+		}
+		if c.Type == typeNoop && !lc.dryRun {
+			errs = append(errs, fmt.Errorf("record for %q is of %s type, which requires -dry-run", key.sender, typeNoop))
+			continue
+		}
+		f, closer, err := newBlacklister(c, lc.refresh, lc.log)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DB connection test failed for %q: %w", key.sender, err))
+			continue
+		}
+		if err := lc.h.register(key, f, closer, queueOpts{
+			tags:       c.Tags,
+			withReason: c.PassComplaintType && key.policy == complaintOnly,
+		}, true); err != nil {
+			closer.Close()
+			errs = append(errs, err)
+			continue
+		}
+		lc.applied[key] = c
+	}
+	for key := range lc.applied {
+		if _, ok := next[key]; ok {
+			continue
+		}
+		if err := lc.h.unregister(key); err != nil {
+			errs = append(errs, err)
+		}
+		delete(lc.applied, key)
+	}
+	return errors.Join(errs...)
+}
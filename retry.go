@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// retryableError can be implemented by blacklister errors to tell retry
+// middleware whether calling blacklister again may succeed
+type retryableError interface {
+	error
+	IsRetryable() bool
+}
+
+// permanentError is blacklister error that should not be retried
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string     { return e.err.Error() }
+func (e permanentError) Unwrap() error     { return e.err }
+func (e permanentError) IsRetryable() bool { return false }
+
+// notRetryable marks err so that retry middleware does not retry it, like
+// for emails database rejected as invalid
+func notRetryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// retryMiddleware returns middleware calling blacklister up to attempts
+// times while it fails, doubling delay between attempts. Errors implementing
+// retryableError whose IsRetryable returns false are returned right away.
+// Retries stop once ctx is canceled.
+func retryMiddleware(ctx context.Context, attempts int, delay time.Duration) middleware {
+	return func(next blacklister) blacklister {
+		return func(email string) error {
+			var err error
+			for i := 0; i < attempts; i++ {
+				if i > 0 {
+					select {
+					case <-ctx.Done():
+						return err
+					case <-time.After(delay << (i - 1)):
+					}
+				}
+				if err = next(email); err == nil {
+					return nil
+				}
+				var re retryableError
+				if errors.As(err, &re) && !re.IsRetryable() {
+					return err
+				}
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// secretResolver fetches secret value by its name
+type secretResolver interface {
+	ResolveSecret(name string) (string, error)
+}
+
+// awsSecrets returns process-wide resolver, creating it on first use
+var awsSecrets = sync.OnceValues(func() (secretResolver, error) {
+	return newAWSSecretResolver()
+})
+
+// awsSecretResolver reads secrets from AWS Secrets Manager, or from SSM
+// Parameter Store if secret name has "ssm:" prefix.
+type awsSecretResolver struct {
+	sm  *secretsmanager.SecretsManager
+	ssm *ssm.SSM
+}
+
+// newAWSSecretResolver returns resolver configured from the environment
+func newAWSSecretResolver() (*awsSecretResolver, error) {
+	sess, err := newAWSSession()
+	if err != nil {
+		return nil, err
+	}
+	return &awsSecretResolver{
+		sm:  secretsmanager.New(sess),
+		ssm: ssm.New(sess),
+	}, nil
+}
+
+func (r *awsSecretResolver) ResolveSecret(name string) (string, error) {
+	if strings.HasPrefix(name, "ssm:") {
+		out, err := r.ssm.GetParameter(&ssm.GetParameterInput{
+			Name:           aws.String(strings.TrimPrefix(name, "ssm:")),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return "", err
+		}
+		return aws.StringValue(out.Parameter.Value), nil
+	}
+	out, err := r.sm.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.SecretString), nil
+}
+
+// secretBlacklister works like sqlBlacklister, but takes DSN from the named
+// secret. If refresh is positive, secret is re-read with such interval and
+// database connection is replaced if DSN changed.
+func secretBlacklister(r secretResolver, name, query string, p poolConfig, refresh time.Duration, logger *log.Logger, args queryArgs) (blacklister, io.Closer, error) {
+	dsn, err := r.ResolveSecret(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := openDB(dsn, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	var mu sync.RWMutex
+	done := make(chan struct{})
+	closer := checkCloser{
+		close: func() error {
+			close(done)
+			mu.Lock()
+			defer mu.Unlock()
+			return db.Close()
+		},
+		check: func(ctx context.Context) error {
+			mu.RLock()
+			cur := db
+			mu.RUnlock()
+			return cur.PingContext(ctx)
+		},
+	}
+	if refresh > 0 {
+		go func() {
+			ticker := time.NewTicker(refresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+				newDSN, err := r.ResolveSecret(name)
+				if err != nil {
+					logger.Printf("secret %q refresh: %v", name, err)
+					continue
+				}
+				if newDSN == dsn {
+					continue
+				}
+				newDB, err := openDB(newDSN, p)
+				if err != nil {
+					logger.Printf("secret %q refresh: %v", name, err)
+					continue
+				}
+				mu.Lock()
+				select {
+				case <-done:
+					mu.Unlock()
+					newDB.Close()
+					return
+				default:
+				}
+				old := db
+				db, dsn = newDB, newDSN
+				mu.Unlock()
+				old.Close()
+				logger.Printf("secret %q changed, database connection replaced", name)
+			}
+		}()
+	}
+	return func(email string) error {
+		mu.RLock()
+		cur := db
+		mu.RUnlock()
+		_, err := cur.Exec(query, args.of(email)...)
+		return err
+	}, closer, nil
+}
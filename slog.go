@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// withSlogHandler makes handler log through structured logger with given
+// handler: request handling logs messages with typed attributes, every SNS
+// message is additionally logged with its metadata, and other log lines are
+// passed to sh as plain messages.
+func withSlogHandler(h *handler, sh slog.Handler) *handler {
+	h.slog = slog.New(sh)
+	h.log = slog.NewLogLogger(sh, slog.LevelInfo)
+	return h
+}
+
+// requestLoggers returns plain and structured loggers for request with given
+// id. Without slog handler structured logger writes to plain one, rendering
+// attributes as key:"value" pairs.
+func (h *handler) requestLoggers(id string) (*log.Logger, *slog.Logger) {
+	if h.slog == nil {
+		lg := withPrefix(h.log, "request-id:"+id+" ")
+		return lg, slog.New(textHandler{l: lg})
+	}
+	sl := h.slog.With(slog.String("request_id", id))
+	return slog.NewLogLogger(sl.Handler(), slog.LevelInfo), sl
+}
+
+// withTopicContext returns request loggers extended with region and account
+// of SNS topic, if arn is valid
+func (h *handler) withTopicContext(lg *log.Logger, sl *slog.Logger, arn string) (*log.Logger, *slog.Logger) {
+	region, account, _, err := parseTopicARN(arn)
+	if err != nil {
+		return lg, sl
+	}
+	if h.slog == nil {
+		lg = withPrefix(lg, "region:"+region+" account:"+account+" ")
+		return lg, slog.New(textHandler{l: lg})
+	}
+	sl = sl.With(slog.String("region", region), slog.String("account_id", account))
+	return slog.NewLogLogger(sl.Handler(), slog.LevelInfo), sl
+}
+
+// parseTopicARN splits SNS topic ARN of "arn:aws:sns:<region>:<account-id>:<topic-name>"
+// form into its parts
+func parseTopicARN(arn string) (region, accountID, topicName string, err error) {
+	parts := strings.Split(arn, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" ||
+		parts[3] == "" || parts[4] == "" || parts[5] == "" {
+		return "", "", "", fmt.Errorf("invalid SNS topic ARN %q", arn)
+	}
+	return parts[3], parts[4], parts[5], nil
+}
+
+// textHandler is slog.Handler writing records to log.Logger in the same
+// key:"value" style as the rest of plain logs. Levels below Info are
+// discarded, others are not shown.
+type textHandler struct {
+	l     *log.Logger
+	attrs string // preformatted attributes added with WithAttrs
+	group string // prefix of attribute keys
+}
+
+func (t textHandler) Enabled(_ context.Context, l slog.Level) bool { return l >= slog.LevelInfo }
+
+func (t textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		t.format(&b, a)
+		return true
+	})
+	b.WriteString(t.attrs)
+	return t.l.Output(2, b.String())
+}
+
+func (t textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	for _, a := range attrs {
+		t.format(&b, a)
+	}
+	t.attrs += b.String()
+	return t
+}
+
+func (t textHandler) WithGroup(name string) slog.Handler {
+	t.group += name + "."
+	return t
+}
+
+func (t textHandler) format(b *strings.Builder, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		g := textHandler{group: t.group}
+		if a.Key != "" {
+			g.group += a.Key + "."
+		}
+		for _, a := range a.Value.Group() {
+			g.format(b, a)
+		}
+		return
+	}
+	fmt.Fprintf(b, " %s%s:%q", t.group, a.Key, a.Value.String())
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteBlacklister returns blacklister inserting emails into table of SQLite
+// database at path, table is created if it does not exist. If emailColumn is
+// empty, "email" is used.
+func sqliteBlacklister(path, table, emailColumn string) (blacklister, io.Closer, error) {
+	if emailColumn == "" {
+		emailColumn = "email"
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, nil, err
+	}
+	// sqlite allows single writer, avoid SQLITE_BUSY errors
+	db.SetMaxOpenConns(1)
+	t, col := quoteIdent(table), quoteIdent(emailColumn)
+	if _, err := db.Exec(fmt.Sprintf("create table if not exists %s (%s text primary key,"+
+		" suppressed_at timestamp not null default current_timestamp)", t, col)); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	query := fmt.Sprintf("insert or ignore into %s (%s) values (?)", t, col)
+	return func(email string) error {
+		_, err := db.Exec(query, email)
+		return err
+	}, dbChecker{db}, nil
+}
+
+// quoteIdent quotes SQL identifier
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// sqsConsumer receives SES notifications from SQS queue subscribed to SNS
+// topic and passes them to handler. With raw message delivery enabled on the
+// subscription, message bodies are SES notification json without SNS
+// wrapping.
+type sqsConsumer struct {
+	url    string
+	raw    bool
+	client sqsiface.SQSAPI
+	h      *handler
+}
+
+func newSQSConsumer(url string, raw bool, client sqsiface.SQSAPI, h *handler) *sqsConsumer {
+	return &sqsConsumer{url: url, raw: raw, client: client, h: h}
+}
+
+// Run receives messages until ctx is canceled or receiving fails. Messages
+// are deleted once queued for processing; malformed ones are logged and left
+// in queue, so that its redrive policy moves them to dead-letter queue.
+func (c *sqsConsumer) Run(ctx context.Context) error {
+	for {
+		out, err := c.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(c.url),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if err != nil {
+			return err
+		}
+		for _, m := range out.Messages {
+			body := []byte(aws.StringValue(m.Body))
+			if c.raw {
+				err = c.h.consumeRaw(body)
+			} else {
+				err = c.h.consume(body)
+			}
+			if err != nil {
+				c.h.log.Printf("sqs message %s: %v", aws.StringValue(m.MessageId), err)
+				continue
+			}
+			if _, err := c.client.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(c.url),
+				ReceiptHandle: m.ReceiptHandle,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const statsPath = "/stats"
+
+// snsStats counts received SNS messages by their type
+type snsStats struct {
+	notification atomic.Uint64
+	subscribe    atomic.Uint64
+	unsubscribe  atomic.Uint64
+	unknown      atomic.Uint64 // unparseable messages or unsupported types
+}
+
+func (s *snsStats) add(typ string) {
+	switch typ {
+	case "Notification":
+		s.notification.Add(1)
+	case "SubscriptionConfirmation":
+		s.subscribe.Add(1)
+	case "UnsubscribeConfirmation":
+		s.unsubscribe.Add(1)
+	default:
+		s.unknown.Add(1)
+	}
+}
+
+func (s *snsStats) snapshot() map[string]uint64 {
+	return map[string]uint64{
+		"Notification":             s.notification.Load(),
+		"SubscriptionConfirmation": s.subscribe.Load(),
+		"UnsubscribeConfirmation":  s.unsubscribe.Load(),
+		"Unknown":                  s.unknown.Load(),
+	}
+}
+
+// senderStats counts emails of sender's blacklisters since the last reset
+type senderStats struct {
+	mu        sync.Mutex
+	processed uint64 // passed to blacklister successfully
+	errors    uint64 // blacklister failed on
+	dropped   uint64 // dropped due to overflow
+	resetAt   time.Time
+}
+
+// senderCounts is snapshot of senderStats
+type senderCounts struct {
+	Processed uint64    `json:"processed"`
+	Errors    uint64    `json:"errors"`
+	Dropped   uint64    `json:"dropped"`
+	ResetAt   time.Time `json:"reset_at"` // or when counting started
+}
+
+func newSenderStats() *senderStats { return &senderStats{resetAt: time.Now()} }
+
+func (s *senderStats) add(processed, errors, dropped int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.processed += uint64(processed)
+	s.errors += uint64(errors)
+	s.dropped += uint64(dropped)
+}
+
+func (s *senderStats) snapshot() senderCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return senderCounts{s.processed, s.errors, s.dropped, s.resetAt}
+}
+
+// ResetCounters zeroes counters and records time of reset, so that they
+// cover interval since then
+func (s *senderStats) ResetCounters() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.processed, s.errors, s.dropped = 0, 0, 0
+	s.resetAt = time.Now()
+}
+
+// senderStatsFor returns counters of sender, creating them if needed. h.mu
+// must be held for writing.
+func (h *handler) senderStatsFor(sender string) *senderStats {
+	st, ok := h.counters[sender]
+	if !ok {
+		st = newSenderStats()
+		h.counters[sender] = st
+	}
+	return st
+}
+
+// ResetCounters resets counters of all senders, see senderStats.ResetCounters
+func (h *handler) ResetCounters() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, st := range h.counters {
+		st.ResetCounters()
+	}
+}
+
+// senderCounts returns snapshot of counters of registered senders
+func (h *handler) senderCounts() map[string]senderCounts {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make(map[string]senderCounts, len(h.counters))
+	for sender, st := range h.counters {
+		if h.registered(sender) {
+			out[sender] = st.snapshot()
+		}
+	}
+	return out
+}
+
+// serveStats writes message counters, per-sender bounce rates, registered
+// senders and their email counters as json object, or in Prometheus text
+// format if request has "format=prometheus" query parameter.
+func (h *handler) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Get("format") == "prometheus" {
+		h.writeMetrics(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Messages    map[string]uint64             `json:"messages"`
+		BounceRates map[string]map[string]float64 `json:"bounce_rates"`
+		Senders     []string                      `json:"senders"`
+		SenderStats map[string]senderCounts       `json:"sender_stats"`
+	}{h.stats.snapshot(), h.rates.snapshot(), h.RegisteredSenders(), h.senderCounts()})
+}
+
+// writeMetrics writes counters reported by /stats in Prometheus text format
+func (h *handler) writeMetrics(w http.ResponseWriter) {
+	counts := h.stats.snapshot()
+	rates := h.rates.snapshot()
+	emails := h.senderCounts()
+	types := sortedKeys(counts)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP bouncehandler_sns_messages_total Received SNS messages by type.")
+	fmt.Fprintln(w, "# TYPE bouncehandler_sns_messages_total counter")
+	for _, k := range types {
+		fmt.Fprintf(w, "bouncehandler_sns_messages_total{type=%q} %d\n", k, counts[k])
+	}
+	fmt.Fprintln(w, "# HELP bouncehandler_bounce_rate Fraction of sent emails that bounced, by sender and time window.")
+	fmt.Fprintln(w, "# TYPE bouncehandler_bounce_rate gauge")
+	for _, sender := range sortedKeys(rates) {
+		for _, win := range bounceRateWindows {
+			fmt.Fprintf(w, "bouncehandler_bounce_rate{sender=%q,window=%q} %g\n", sender, win.name, rates[sender][win.name])
+		}
+	}
+	fmt.Fprintln(w, "# HELP bouncehandler_emails_total Emails handled by sender blacklisters since the last counters reset, by result.")
+	fmt.Fprintln(w, "# TYPE bouncehandler_emails_total counter")
+	for _, sender := range sortedKeys(emails) {
+		c := emails[sender]
+		fmt.Fprintf(w, "bouncehandler_emails_total{sender=%q,result=\"processed\"} %d\n", sender, c.Processed)
+		fmt.Fprintf(w, "bouncehandler_emails_total{sender=%q,result=\"error\"} %d\n", sender, c.Errors)
+		fmt.Fprintf(w, "bouncehandler_emails_total{sender=%q,result=\"dropped\"} %d\n", sender, c.Dropped)
+	}
+}
+
+// serveMetrics serves metrics of h in Prometheus text format at /metrics on
+// addr. It does not require authentication, so that addr can be exposed to
+// Prometheus only, separately from the SNS endpoint.
+func serveMetrics(addr string, h *handler, logger *log.Logger) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, _ *http.Request) { h.writeMetrics(w) })
+	srv := &http.Server{Addr: addr, Handler: mux, ErrorLog: logger}
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// snsStream publishes processed events to SNS topic
+type snsStream struct {
+	topic  string
+	client snsiface.SNSAPI
+}
+
+// streamEvent is json published for every processed bounce and complaint
+type streamEvent struct {
+	Type             string            `json:"type"` // Bounce or Complaint
+	Sender           string            `json:"sender"`
+	Recipients       []streamRecipient `json:"recipients"`
+	MessageID        string            `json:"messageId,omitempty"` // of original email, assigned by SES
+	ConfigurationSet string            `json:"configurationSet,omitempty"`
+	Timestamp        time.Time         `json:"timestamp"`
+	Tags             map[string]string `json:"tags,omitempty"` // of the matched config record
+
+	IntendedRecipients int `json:"intendedRecipients,omitempty"` // number of all recipients of email
+}
+
+type streamRecipient struct {
+	Email  string `json:"email"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// withForwardToSNS makes handler publish every processed bounce and
+// complaint event to SNS topic as json, for analytics pipelines to consume
+// independently of blacklisters. Events are published in background,
+// failures are only logged.
+func withForwardToSNS(h *handler, topicARN string, client snsiface.SNSAPI) *handler {
+	h.stream = &snsStream{topic: topicARN, client: client}
+	return h
+}
+
+// publish sends ev to SNS topic in background. Does nothing if s is nil.
+func (s *snsStream) publish(lg *log.Logger, ev *bounceEvent, tags map[string]string) {
+	if s == nil {
+		return
+	}
+	out := streamEvent{
+		Type:             ev.EventType,
+		Sender:           ev.Sender,
+		MessageID:        ev.Mail.MessageID,
+		ConfigurationSet: ev.Mail.configSet(),
+		Timestamp:        ev.Timestamp,
+		Tags:             tags,
+
+		IntendedRecipients: len(ev.Mail.Destination),
+	}
+	for _, r := range ev.Recipients {
+		out.Recipients = append(out.Recipients, streamRecipient{Email: r.Email, Reason: r.Reason})
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		lg.Printf("sns forward: %v", err)
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if _, err := s.client.PublishWithContext(ctx, &sns.PublishInput{
+			TopicArn: aws.String(s.topic),
+			Message:  aws.String(string(b)),
+		}); err != nil {
+			lg.Printf("sns forward: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// tenantPrefix is a path prefix of tenant endpoints, followed by tenant name
+const tenantPrefix = "/tenant/"
+
+// tenantConfig defines a tenant: its basic auth credentials and sender
+// records, isolated from other tenants
+type tenantConfig struct {
+	User    string          `json:"user"`
+	Pass    string          `json:"pass"`
+	Senders map[string]cred `json:"senders"`
+}
+
+// tenant is a handler serving requests under tenantPrefix+name path
+type tenant struct {
+	h          *handler
+	user, pass string
+}
+
+// setTenant makes h pass requests under tenantPrefix+name path to th,
+// authenticating them with given credentials instead of ones of h.
+func (h *handler) setTenant(name string, th *handler, user, pass string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tenants == nil {
+		h.tenants = make(map[string]*tenant)
+	}
+	h.tenants[name] = &tenant{h: th, user: user, pass: pass}
+}
+
+// removeTenant stops routing requests to the named tenant
+func (h *handler) removeTenant(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.tenants, name)
+}
+
+// serveTenant passes request to handler of tenant named in its path, with
+// tenant prefix stripped from path
+func (h *handler) serveTenant(w http.ResponseWriter, r *http.Request) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, tenantPrefix), "/")
+	h.mu.RLock()
+	t, ok := h.tenants[name]
+	h.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if t.user != "" && t.pass != "" {
+		if u, p, ok := r.BasicAuth(); !ok || u != t.user || p != t.pass {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+name+`"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path, r2.URL.RawPath = "/"+rest, ""
+	t.h.ServeHTTP(w, r2)
+}
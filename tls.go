@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serverTLSConfig returns tls configuration for the server, or nil if plain
+// http should be used. Server certificate is either obtained from Let's
+// Encrypt for domain, or loaded from certFile and keyFile. If caFile is set,
+// clients are required to present certificates signed by CA from this file.
+// Certificate files are checked for changes every reload interval, if it is
+// positive, and reloaded without restart.
+func serverTLSConfig(domain, acmeCache, certFile, keyFile, caFile string, reload time.Duration, logger *log.Logger) (*tls.Config, error) {
+	var cfg *tls.Config
+	switch {
+	case domain != "" && (certFile != "" || keyFile != ""):
+		return nil, errors.New("-tls-domain and -tls-cert/-tls-key are mutually exclusive")
+	case domain != "":
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domain),
+			Cache:      autocert.DirCache(acmeCache),
+		}
+		cfg = m.TLSConfig()
+	case certFile != "" || keyFile != "":
+		cr := &certReloader{certFile: certFile, keyFile: keyFile, log: logger}
+		if err := cr.load(); err != nil {
+			return nil, err
+		}
+		if reload > 0 {
+			go cr.watch(reload)
+		}
+		cfg = &tls.Config{GetCertificate: cr.getCertificate}
+	}
+	if caFile == "" {
+		return cfg, nil
+	}
+	if cfg == nil {
+		return nil, errors.New("-tls-ca requires either -tls-domain or -tls-cert/-tls-key")
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", caFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
+
+// certReloader serves certificate loaded from files, reloading it once files
+// change
+type certReloader struct {
+	certFile, keyFile string
+	log               *log.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of both files when loaded
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// modified returns latest modification time of certificate and key files
+func (cr *certReloader) modified() (time.Time, error) {
+	var t time.Time
+	for _, name := range [...]string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// load reads certificate from files, replacing current one
+func (cr *certReloader) load() error {
+	mod, err := cr.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	// Leaf is not set by LoadX509KeyPair with x509keypairleaf=0 GODEBUG
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert, cr.modTime = &cert, mod
+	return nil
+}
+
+// watch checks certificate files every interval, reloading them if either
+// was modified. Failed reloads keep current certificate.
+func (cr *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		mod, err := cr.modified()
+		if err != nil {
+			cr.log.Printf("tls certificate reload: %v", err)
+			continue
+		}
+		cr.mu.RLock()
+		changed := mod.After(cr.modTime)
+		cr.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := cr.load(); err != nil {
+			cr.log.Printf("tls certificate reload: %v", err)
+			continue
+		}
+		cr.mu.RLock()
+		expires := cr.cert.Leaf.NotAfter
+		cr.mu.RUnlock()
+		cr.log.Printf("reloaded tls certificate from %s, expires %s", cr.certFile,
+			expires.UTC().Format(time.RFC3339))
+	}
+}
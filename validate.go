@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// validateCmd implements "validate" sub-command: it reads configuration and
+// checks that every configured database is reachable, reporting results for
+// each record. It returns non-nil error if config is invalid or any check
+// failed.
+func validateCmd(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	conf := fs.String("config", "mapping.json", "configuration file")
+	fs.Parse(args)
+	var explicit bool
+	fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "config" })
+	c, err := loadConfig(*conf, explicit)
+	if err != nil {
+		return err
+	}
+	creds := make(map[string]cred, len(c.senders))
+	for k, v := range c.senders {
+		creds[k] = v
+	}
+	for name, t := range c.tenants {
+		for k, v := range t.Senders {
+			creds[tenantPrefix+name+"/"+k] = v
+		}
+	}
+	keys := make([]string, 0, len(creds))
+	for k := range creds {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var failed int
+	for _, k := range keys {
+		if err := checkCred(creds[k]); err != nil {
+			failed++
+			fmt.Fprintf(os.Stdout, "%q: FAIL: %v\n", k, err)
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%q: ok\n", k)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d records failed", failed, len(keys))
+	}
+	return nil
+}
+
+// checkCred verifies database of config record is reachable
+func checkCred(c cred) error {
+	if c.Type == typeNoop {
+		return nil
+	}
+	if c.Type == typeMongo {
+		client, err := openMongo(c.URI)
+		if err != nil {
+			return err
+		}
+		return client.Disconnect(context.Background())
+	}
+	if c.Type == typeSQLite {
+		// read-only, so that missing database file or table is not created
+		db, err := sql.Open("sqlite", "file:"+c.Path+"?mode=ro")
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.PingContext(context.Background())
+	}
+	dsn, err := c.fileDSN()
+	if err != nil {
+		return err
+	}
+	if c.DSNSecret != "" {
+		r, err := awsSecrets()
+		if err != nil {
+			return err
+		}
+		if dsn, err = r.ResolveSecret(c.DSNSecret); err != nil {
+			return err
+		}
+	}
+	if c.IAMAuth {
+		_, closer, err := iamBlacklister(dsn, c.sql(), c.poolConfig, log.New(io.Discard, "", 0), nil)
+		if err != nil {
+			return err
+		}
+		return closer.Close()
+	}
+	db, err := openDB(dsn, c.poolConfig)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+)
+
+// printVersion writes module path and version, Go version and VCS commit
+// the binary was built from
+func printVersion(w io.Writer) {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		fmt.Fprintln(w, "build info is not available")
+		return
+	}
+	fmt.Fprintf(w, "%s %s\n", bi.Main.Path, bi.Main.Version)
+	fmt.Fprintf(w, "go: %s\n", bi.GoVersion)
+	settings := make(map[string]string, len(bi.Settings))
+	for _, s := range bi.Settings {
+		settings[s.Key] = s.Value
+	}
+	if rev := settings["vcs.revision"]; rev != "" {
+		if settings["vcs.modified"] == "true" {
+			rev += " (modified)"
+		}
+		fmt.Fprintf(w, "commit: %s\n", rev)
+	}
+	if t := settings["vcs.time"]; t != "" {
+		fmt.Fprintf(w, "commit time: %s\n", t)
+	}
+}